@@ -7,6 +7,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 const defaultPassword = "111111"
@@ -28,6 +29,8 @@ func routesAdmin(r *gin.Engine) {
 	admin.POST("/forget_password", forgetPassword)
 	admin.POST("/delete_user", deleteUser)
 	admin.POST("/delete_group", deleteGroup)
+	admin.POST("/message_edits", showMessageEdits)
+	admin.POST("/delete_message", deleteAnyMessage)
 
 	log.Printf("超级管理员密码 %s", adminToken)
 }
@@ -160,13 +163,74 @@ func deleteGroup(c *gin.Context) {
 		return
 	}
 
-	db.Model(&Group{}).Delete(&group)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&Group{}, "id = ?", group.Id).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&ConvSetting{}, "conv_id = ?", group.Id).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "删除群组失败",
+		})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "删除群组成功",
 	})
 }
 
+// post /admin/message_edits
+func showMessageEdits(c *gin.Context) {
+	var msg struct {
+		Id uint `json:"id" binding:"required"`
+	}
+
+	a := jsonData(&msg, c)
+	if !a {
+		return
+	}
+
+	edits, err := msgEdits(msg.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索编辑历史失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"edits": edits,
+	})
+}
+
+// post /admin/delete_message
+func deleteAnyMessage(c *gin.Context) {
+	var msg struct {
+		Id uint `json:"id" binding:"required"`
+	}
+
+	a := jsonData(&msg, c)
+	if !a {
+		return
+	}
+
+	target, err := findLiveMsg(msg.Id, 0)
+	if err == nil {
+		err = removeMessage(target, 0)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "删除消息成功",
+	})
+}
+
 func jsonData[T any](model *T, c *gin.Context) bool {
 	err := c.ShouldBindJSON(model)
 	if err != nil {
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker 在实例间转发实时事件。每个实例订阅全部事件并投递给本地连接，
+// 本实例发布的事件同样经由订阅回到本地，单实例与多实例走同一条路径
+type Broker interface {
+	Publish(ev brokerEvent) error
+	Subscribe(handler func(brokerEvent)) error
+	Close() error
+}
+
+const (
+	eventConv   = "conv"   // 会话内广播
+	eventUser   = "user"   // 推送给用户的全部连接
+	eventNotify = "notify" // 推送给未订阅该会话的多路复用连接
+	eventRevoke = "revoke" // 用户不再是会话成员，断开其对该会话的订阅
+)
+
+type brokerEvent struct {
+	Kind    string `json:"kind"`
+	ConvId  int    `json:"conv_id,omitempty"`
+	UserIds []int  `json:"user_ids,omitempty"`
+	Op      string `json:"op"`
+	MsgId   uint   `json:"msg_id,omitempty"` // 非零时按消息去重
+	Payload any    `json:"payload"`
+}
+
+var broker Broker
+
+func initBroker() {
+	var err error
+	switch brokerKind {
+	case "memory":
+		broker = &memoryBroker{}
+	case "redis":
+		broker, err = newRedisBroker(redisAddr, redisChannel)
+		log.Println("[warn] 在线状态、限流和慢速模式按实例统计，多实例部署时可能不准确")
+	default:
+		log.Fatalf("[err] 未知的 MOMO_BROKER: %s", brokerKind)
+	}
+	if err != nil {
+		log.Fatal("[err]", err)
+	}
+
+	err = broker.Subscribe(dispatch)
+	if err != nil {
+		log.Fatal("[err]", err)
+	}
+}
+
+func publish(ev brokerEvent) {
+	err := broker.Publish(ev)
+	if err != nil {
+		// 中转不可用时至少保证本实例的连接能收到
+		log.Printf("Broker publish error: %v", err)
+		dispatch(ev)
+	}
+}
+
+// dispatch 将事件投递给本实例上的连接
+func dispatch(ev brokerEvent) {
+	if ev.MsgId != 0 && !delivered.first(ev.Op, ev.MsgId) {
+		return
+	}
+	if ev.Kind == eventRevoke {
+		dropSubscriptions(ev.ConvId, ev.UserIds)
+		return
+	}
+
+	clientManager.RLock()
+	defer clientManager.RUnlock()
+
+	switch ev.Kind {
+	case eventConv:
+		for client := range clientManager.clients[ev.ConvId] {
+			client.deliver(ev.ConvId, ev.Op, ev.Payload)
+		}
+	case eventUser:
+		for _, userId := range ev.UserIds {
+			for client := range clientManager.users[userId] {
+				client.send(ev.Op, ev.Payload)
+			}
+		}
+	case eventNotify:
+		for _, userId := range ev.UserIds {
+			for client := range clientManager.users[userId] {
+				if !client.mux || client.subs[ev.ConvId] {
+					continue
+				}
+				client.send(ev.Op, ev.Payload)
+			}
+		}
+	}
+}
+
+const dedupSize = 4096
+
+type dedupKey struct {
+	op    string
+	msgId uint
+}
+
+// msgDedup 记录最近投递过的消息，超出容量后淘汰最早的记录
+type msgDedup struct {
+	seen  map[dedupKey]bool
+	order []dedupKey
+	next  int
+	sync.Mutex
+}
+
+var delivered = msgDedup{
+	seen:  make(map[dedupKey]bool),
+	order: make([]dedupKey, dedupSize),
+}
+
+func (d *msgDedup) first(op string, msgId uint) bool {
+	key := dedupKey{op, msgId}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.seen[key] {
+		return false
+	}
+	delete(d.seen, d.order[d.next])
+	d.order[d.next] = key
+	d.next = (d.next + 1) % len(d.order)
+	d.seen[key] = true
+	return true
+}
+
+// memoryBroker 仅在进程内转发，适用于单实例部署
+type memoryBroker struct {
+	handlers []func(brokerEvent)
+	sync.RWMutex
+}
+
+func (b *memoryBroker) Publish(ev brokerEvent) error {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(ev)
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(handler func(brokerEvent)) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+// redisBroker 通过 Redis 发布订阅在多个实例间转发事件
+type redisBroker struct {
+	client  *redis.Client
+	channel string
+
+	mu     sync.Mutex
+	pubsub []*redis.PubSub
+}
+
+func newRedisBroker(addr, channel string) (*redisBroker, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	err := client.Ping(context.Background()).Err()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisBroker{
+		client:  client,
+		channel: channel,
+	}, nil
+}
+
+func (b *redisBroker) Publish(ev brokerEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, data).Err()
+}
+
+// Subscribe 在订阅确认后返回，之后发布的事件都会按顺序交给 handler
+func (b *redisBroker) Subscribe(handler func(brokerEvent)) error {
+	ctx := context.Background()
+	pubsub := b.client.Subscribe(ctx, b.channel)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.pubsub = append(b.pubsub, pubsub)
+	b.mu.Unlock()
+
+	go func() {
+		for m := range pubsub.Channel() {
+			ev, err := decodeEvent([]byte(m.Payload))
+			if err != nil {
+				log.Printf("Broker decode error: %v", err)
+				continue
+			}
+			handler(ev)
+		}
+	}()
+	return nil
+}
+
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	for _, pubsub := range b.pubsub {
+		pubsub.Close()
+	}
+	b.pubsub = nil
+	b.mu.Unlock()
+
+	return b.client.Close()
+}
+
+// decodeEvent 还原事件负载，消息帧还原为 MsgView 以便补发期间去重，
+// 其他事件还原为 gin.H 以便 v1 协议展开字段
+func decodeEvent(data []byte) (brokerEvent, error) {
+	var raw struct {
+		brokerEvent
+		Payload json.RawMessage `json:"payload"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return brokerEvent{}, err
+	}
+
+	ev := raw.brokerEvent
+	if ev.Op == "message" {
+		var view MsgView
+		err = json.Unmarshal(raw.Payload, &view)
+		ev.Payload = view
+		return ev, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw.Payload))
+	dec.UseNumber()
+	var h gin.H
+	err = dec.Decode(&h)
+	ev.Payload = h
+	return ev, err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+)
+
+const brokerTestWait = 2 * time.Second
+
+// newTestBrokers 返回连接同一个内嵌 Redis 的两个 redisBroker，模拟两个实例
+func newTestBrokers(t *testing.T) (*redisBroker, *redisBroker) {
+	t.Helper()
+	s := miniredis.RunT(t)
+
+	brokers := make([]*redisBroker, 2)
+	for i := range brokers {
+		b, err := newRedisBroker(s.Addr(), "test:events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		brokers[i] = b
+	}
+	return brokers[0], brokers[1]
+}
+
+func receive(t *testing.T, ch <-chan brokerEvent) brokerEvent {
+	t.Helper()
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(brokerTestWait):
+		t.Fatal("timed out waiting for event")
+		return brokerEvent{}
+	}
+}
+
+func TestRedisBrokerDelivery(t *testing.T) {
+	a, b := newTestBrokers(t)
+
+	gotA := make(chan brokerEvent, 4)
+	gotB := make(chan brokerEvent, 4)
+	err := a.Subscribe(func(ev brokerEvent) { gotA <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Subscribe(func(ev brokerEvent) { gotB <- ev })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := MsgView{Msg: Msg{ID: 7, ConvId: 100001, Seq: 3, UserId: 1, Text: "你好"}}
+	err = a.Publish(brokerEvent{Kind: eventConv, ConvId: 100001, Op: "message", MsgId: 7, Payload: msg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ch := range map[string]chan brokerEvent{"a": gotA, "b": gotB} {
+		ev := receive(t, ch)
+		view, ok := ev.Payload.(MsgView)
+		if !ok {
+			t.Fatalf("%s: payload is %T, want MsgView", name, ev.Payload)
+		}
+		if ev.Kind != eventConv || ev.ConvId != 100001 || ev.MsgId != 7 {
+			t.Errorf("%s: got event %+v", name, ev)
+		}
+		if view.ID != 7 || view.Seq != 3 || view.Text != "你好" {
+			t.Errorf("%s: got message %+v", name, view.Msg)
+		}
+	}
+
+	err = b.Publish(brokerEvent{Kind: eventUser, UserIds: []int{1, 2}, Op: "presence", Payload: gin.H{
+		"user_id": 2,
+		"online":  true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev := receive(t, gotA)
+	h, ok := ev.Payload.(gin.H)
+	if !ok {
+		t.Fatalf("payload is %T, want gin.H", ev.Payload)
+	}
+	if h["user_id"] != json.Number("2") || h["online"] != true {
+		t.Errorf("got payload %v", h)
+	}
+	if len(ev.UserIds) != 2 {
+		t.Errorf("got user ids %v", ev.UserIds)
+	}
+	receive(t, gotB)
+}
+
+func TestRedisBrokerDedup(t *testing.T) {
+	a, b := newTestBrokers(t)
+
+	// 两个订阅都投递到本进程的 clientManager，同一条消息只应下发一次
+	for _, br := range []*redisBroker{a, b} {
+		err := br.Subscribe(dispatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	delivered.Lock()
+	clear(delivered.seen)
+	delivered.Unlock()
+
+	const convId = 100002
+	cl := &wsClient{
+		userId: 1,
+		proto:  protoV2,
+		subs:   make(map[int]bool),
+		out:    make(chan any, 16),
+		done:   make(chan struct{}),
+	}
+	clientManager.subscribe(cl, convId)
+	t.Cleanup(func() { clientManager.unsubscribe(cl, convId) })
+
+	publishMsg := func(br Broker, msgId uint) {
+		t.Helper()
+		err := br.Publish(brokerEvent{Kind: eventConv, ConvId: convId, Op: "message", MsgId: msgId, Payload: MsgView{
+			Msg: Msg{ID: msgId, ConvId: convId},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publishMsg(a, 9001)
+	publishMsg(b, 9001)
+	publishMsg(a, 9002)
+
+	var ids []uint
+	timeout := time.After(brokerTestWait)
+	for len(ids) < 2 {
+		select {
+		case frame := <-cl.out:
+			ids = append(ids, frame.(wsEnvelope).Payload.(MsgView).ID)
+		case <-timeout:
+			t.Fatalf("timed out, got %v", ids)
+		}
+	}
+
+	select {
+	case frame := <-cl.out:
+		t.Fatalf("duplicate frame delivered: %+v", frame)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if ids[0] != 9001 || ids[1] != 9002 {
+		t.Errorf("got message ids %v, want [9001 9002]", ids)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 运行参数，可通过同名环境变量覆盖
+var (
+	editWindow      = envDuration("MOMO_EDIT_WINDOW", 15*time.Minute)
+	recallWindow    = envDuration("MOMO_RECALL_WINDOW", 2*time.Minute)
+	defaultPinLimit = envInt("MOMO_PIN_LIMIT", 20)
+	sendQueueSize   = envPositiveInt("MOMO_SEND_QUEUE", 256)
+	pingInterval    = envDuration("MOMO_WS_PING_INTERVAL", 30*time.Second)
+	pongWait        = envDuration("MOMO_WS_PONG_WAIT", 60*time.Second)
+	writeWait       = envDuration("MOMO_WS_WRITE_WAIT", 10*time.Second)
+	maxFrameSize    = envPositiveInt("MOMO_MAX_FRAME", 64<<10)
+	maxTextLen      = envPositiveInt("MOMO_MAX_TEXT", 4000)
+	userRate        = envInt("MOMO_USER_RATE", 5)
+	userBurst       = envInt("MOMO_USER_BURST", 10)
+	convRate        = envInt("MOMO_CONV_RATE", 20)
+	convBurst       = envInt("MOMO_CONV_BURST", 40)
+	userCacheTTL    = envDuration("MOMO_USER_CACHE_TTL", 5*time.Minute)
+	dropMsgUserName = envBool("MOMO_DROP_MSG_USER_NAME", false)
+	brokerKind      = envString("MOMO_BROKER", "memory") // redis 只转发实时事件，在线状态、限流和慢速模式仍按实例统计
+	redisAddr       = envString("MOMO_REDIS_ADDR", "127.0.0.1:6379")
+	redisChannel    = envString("MOMO_REDIS_CHANNEL", "momo:events")
+)
+
+func init() {
+	// 心跳间隔必须短于等待时间，否则健康连接也会超时
+	if pingInterval >= pongWait {
+		log.Printf("[warn] MOMO_WS_PING_INTERVAL 应小于 MOMO_WS_PONG_WAIT，已调整为 %s", pongWait*9/10)
+		pingInterval = pongWait * 9 / 10
+	}
+}
+
+func envInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("[warn] %s 无效，使用默认值 %d", key, def)
+		return def
+	}
+	return n
+}
+
+// envPositiveInt 用于队列长度等必须为正的参数，不大于 0 时使用默认值
+func envPositiveInt(key string, def int) int {
+	n := envInt(key, def)
+	if n <= 0 {
+		log.Printf("[warn] %s 必须大于 0，使用默认值 %d", key, def)
+		return def
+	}
+	return n
+}
+
+func envString(key, def string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("[warn] %s 无效，使用默认值 %t", key, def)
+		return def
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	// 时长都必须为正，为 0 时 time.NewTicker 等会直接 panic
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("[warn] %s 无效，使用默认值 %s", key, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const previewLength = 50
+
+type convPreview struct {
+	ID       uint      `json:"id"`
+	UserId   int       `json:"user_id"`
+	UserName string    `json:"user_name"`
+	Text     string    `json:"text"`
+	Type     int       `json:"type"`
+	Time     Timestamp `json:"time"`
+}
+
+type convEntry struct {
+	ConvId   int          `json:"conv_id"`
+	Kind     string       `json:"kind"`
+	TargetId int          `json:"target_id"`
+	Name     string       `json:"name"`
+	LastMsg  *convPreview `json:"last_message"`
+	Unread   int64        `json:"unread"`
+	ActiveAt *Timestamp   `json:"active_at"`
+}
+
+// get /api/v1/conversations
+func conversationList(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+	page, size := pagination(c)
+
+	convs, total, err := userConversations(userId, (page-1)*size, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索会话失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversations": convs,
+		"total":         total,
+		"page":          page,
+	})
+}
+
+// userConversations 按最近一条消息倒序分页列出用户的群聊与私聊，没有消息的会话排在最后。
+// 消息 ID 随时间递增，按最后一条消息的 ID 排序即按活跃时间排序
+func userConversations(userId, offset, limit int) ([]convEntry, int64, error) {
+	var groupCount, directCount int64
+	err := db.Model(&GroupMember{}).
+		Where("user_id = ?", userId).
+		Count(&groupCount).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	err = db.Model(&DirectConv{}).
+		Where("user_id = ?", userId).
+		Count(&directCount).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rows []struct {
+		ConvId   int
+		Kind     string
+		TargetId int
+		Name     string
+		LastId   *uint
+	}
+	err = db.Raw(`SELECT conv_id, kind, target_id, name, last_id FROM (
+			SELECT g.id AS conv_id, 'group' AS kind, g.id AS target_id, g.name AS name,
+				(SELECT MAX(id) FROM msgs WHERE msgs.conv_id = g.id) AS last_id
+			FROM group_members gm JOIN groups g ON g.id = gm.group_id
+			WHERE gm.user_id = ?
+			UNION ALL
+			SELECT d.conv_id, 'direct', d.peer_id, u.name,
+				(SELECT MAX(id) FROM msgs WHERE msgs.conv_id = d.conv_id)
+			FROM direct_convs d JOIN users u ON u.id = d.peer_id
+			WHERE d.user_id = ?
+		) c
+		ORDER BY last_id IS NULL, last_id DESC, conv_id
+		LIMIT ? OFFSET ?`, userId, userId, limit, offset).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	convs := make([]convEntry, len(rows))
+	convIds := make([]int, len(rows))
+	var lastIds []uint
+	for i, r := range rows {
+		convs[i] = convEntry{ConvId: r.ConvId, Kind: r.Kind, TargetId: r.TargetId, Name: r.Name}
+		convIds[i] = r.ConvId
+		if r.LastId != nil {
+			lastIds = append(lastIds, *r.LastId)
+		}
+	}
+
+	var lastMsgs []Msg
+	if len(lastIds) > 0 {
+		err = db.Find(&lastMsgs, lastIds).Error
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	fillSenderNames(lastMsgs)
+	lastByConv := make(map[int]Msg, len(lastMsgs))
+	for _, m := range lastMsgs {
+		lastByConv[m.ConvId] = m
+	}
+
+	unreadByConv, err := unreadCounts(userId, convIds)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range convs {
+		conv := &convs[i]
+		conv.Unread = unreadByConv[conv.ConvId]
+		if m, ok := lastByConv[conv.ConvId]; ok {
+			conv.LastMsg = previewOf(m)
+			conv.ActiveAt = &m.Time
+		}
+	}
+
+	return convs, groupCount + directCount, nil
+}
+
+func unreadCounts(userId int, convIds []int) (map[int]int64, error) {
+	unread := make(map[int]int64, len(convIds))
+	if len(convIds) == 0 {
+		return unread, nil
+	}
+
+	var counts []struct {
+		ConvId int
+		Unread int64
+	}
+	err := db.Model(&Msg{}).
+		Select("msgs.conv_id, COUNT(*) AS unread").
+		Joins("LEFT JOIN conv_reads ON conv_reads.conv_id = msgs.conv_id AND conv_reads.user_id = ?", userId).
+		Where("msgs.conv_id IN ? AND msgs.user_id <> ?", convIds, userId).
+		Where("msgs.id > COALESCE(conv_reads.last_read_id, 0)").
+		Group("msgs.conv_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range counts {
+		unread[n.ConvId] = n.Unread
+	}
+	return unread, nil
+}
+
+func userConvIds(userId int) ([]int, error) {
+	var groupIds []int
+	err := db.Model(&GroupMember{}).
+		Where("user_id = ?", userId).
+		Pluck("group_id", &groupIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var directIds []int
+	err = db.Model(&DirectConv{}).
+		Where("user_id = ?", userId).
+		Pluck("conv_id", &directIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return append(groupIds, directIds...), nil
+}
+
+func previewOf(m Msg) *convPreview {
+	var text string
+	switch {
+	case m.Deleted:
+		text = "[消息已删除]"
+	case m.Type == msgImage:
+		text = "[图片]"
+	case m.Type == msgFile:
+		text = "[文件]"
+	case m.Type == msgAudio:
+		text = "[语音]"
+	case m.Type == msgSticker:
+		text = "[表情]"
+	default:
+		text = m.Text
+		if runes := []rune(text); len(runes) > previewLength {
+			text = string(runes[:previewLength]) + "…"
+		}
+	}
+
+	return &convPreview{
+		ID:       m.ID,
+		UserId:   m.UserId,
+		UserName: userDirectory.name(m.UserId),
+		Text:     text,
+		Type:     m.Type,
+		Time:     m.Time,
+	}
+}
+
+func pagination(c *gin.Context) (page, size int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	size, err = strconv.Atoi(c.DefaultQuery("size", "20"))
+	if err != nil || size < 1 || size > 100 {
+		size = 20
+	}
+
+	return page, size
+}
+
+func isGroupConv(convId int) bool {
+	return convId >= 100000 && convId <= 999999
+}
+
+func isConvMember(convId, userId int) (bool, error) {
+	var count int64
+	var err error
+	if isGroupConv(convId) {
+		err = db.Model(&GroupMember{}).
+			Where("group_id = ? AND user_id = ?", convId, userId).
+			Count(&count).Error
+	} else {
+		err = db.Model(&DirectConv{}).
+			Where("conv_id = ? AND user_id = ?", convId, userId).
+			Count(&count).Error
+	}
+	return count > 0, err
+}
+
+func convMemberIds(convId int) ([]int, error) {
+	var memberIds []int
+	var err error
+	if isGroupConv(convId) {
+		err = db.Model(&GroupMember{}).
+			Where("group_id = ?", convId).
+			Pluck("user_id", &memberIds).Error
+	} else {
+		err = db.Model(&DirectConv{}).
+			Where("conv_id = ?", convId).
+			Pluck("user_id", &memberIds).Error
+	}
+	return memberIds, err
+}
+
+var errConvConflict = &wsError{"conv_conflict", "会话 ID 冲突，无法创建私聊"}
+
+// ensureDirectConv 记录私聊双方，会话 ID 已属于另一对用户时返回 errConvConflict
+func ensureDirectConv(convId, userId, peerId int) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var members []int
+		err := tx.Model(&DirectConv{}).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("conv_id = ?", convId).
+			Pluck("user_id", &members).Error
+		if err != nil {
+			return err
+		}
+		for _, id := range members {
+			if id != userId && id != peerId {
+				return errConvConflict
+			}
+		}
+
+		rows := []DirectConv{
+			{ConvId: convId, UserId: userId, PeerId: peerId},
+			{ConvId: convId, UserId: peerId, PeerId: userId},
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+	})
+}
+
+func markConvRead(convId, userId int, msgId uint) (bool, error) {
+	if msgId == 0 {
+		return false, nil
+	}
+
+	now := utcNow()
+	read := ConvRead{
+		ConvId:     convId,
+		UserId:     userId,
+		LastReadId: msgId,
+		ReadAt:     now,
+	}
+
+	var advanced bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// read_at 需先于 last_read_id 更新，否则比较的是新值
+		result := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "conv_id"}, {Name: "user_id"}},
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "read_at"}, Value: gorm.Expr("IF(? > last_read_id, ?, read_at)", msgId, now)},
+				{Column: clause.Column{Name: "last_read_id"}, Value: gorm.Expr("GREATEST(last_read_id, ?)", msgId)},
+			},
+		}).Create(&read)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		// 游标未前进时 MySQL 返回 0 行受影响
+		advanced = result.RowsAffected > 0
+		if !advanced || isGroupConv(convId) {
+			return nil
+		}
+		return tx.Create(&ReadAdvance{ConvId: convId, UserId: userId, UpToId: msgId, ReadAt: now}).Error
+	})
+	return advanced, err
+}
+
+func latestMsgId(convId int) (uint, error) {
+	var id uint
+	err := db.Model(&Msg{}).
+		Select("COALESCE(MAX(id), 0)").
+		Where("conv_id = ?", convId).
+		Scan(&id).Error
+	return id, err
+}
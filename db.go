@@ -8,34 +8,105 @@ import (
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
 var db *gorm.DB
 
 type User struct {
-	ID       int    `json:"id" gorm:"primaryKey"`
-	Name     string `json:"name" gorm:"not null"`
-	Password string `json:"password" gorm:"size:64;not null"`
+	ID           int        `json:"id" gorm:"primaryKey"`
+	Name         string     `json:"name" gorm:"not null"`
+	Password     string     `json:"password" gorm:"size:64;not null"`
+	LastSeen     *Timestamp `json:"last_seen"`
+	HideLastSeen bool       `json:"hide_last_seen" gorm:"not null;default:false"`
+	TimeZone     string     `json:"time_zone" gorm:"size:64;not null;default:''"` // IANA 时区名，空为 UTC
 }
 
 type Session struct {
 	ID        string    `json:"id" gorm:"primaryKey;size:36"`
 	UserId    int       `json:"user_id"`
-	ExpiresAt time.Time `json:"expires_at" gorm:"not null"`
+	ExpiresAt Timestamp `json:"expires_at" gorm:"not null"`
 	User      User      `gorm:"constraint:OnDelete:CASCADE;"`
 }
 
 type Msg struct {
-	ID       uint      `gorm:"primaryKey;auto_increment"`
-	ConvId   int       `gorm:"not null"`
-	UserId   int       `json:"user_id"`
-	UserName string    `json:"user_name" gorm:"not null"`
-	Time     time.Time `gorm:"autoCreateTime"`
-	FmtTime  string    `json:"time" gorm:"not null"`
+	ID              uint       `json:"id" gorm:"primaryKey;auto_increment"`
+	ConvId          int        `json:"conv_id" gorm:"not null;uniqueIndex:idx_msgs_client,priority:1;uniqueIndex:idx_msgs_seq,priority:1"`
+	Seq             uint64     `json:"seq" gorm:"not null;default:0;uniqueIndex:idx_msgs_seq,priority:2"`
+	UserId          int        `json:"user_id" gorm:"uniqueIndex:idx_msgs_client,priority:2"`
+	UserName        string     `json:"user_name" gorm:"-"` // 下发时由 userDirectory 解析
+	Time            Timestamp  `json:"time" gorm:"autoCreateTime"`
+	Text            string     `json:"text" gorm:"not null"`
+	Type            int        `json:"type" gorm:"not null"`
+	FileId          *string    `json:"file_id,omitempty" gorm:"size:36;index"`
+	ClientId        *string    `json:"client_id,omitempty" gorm:"size:64;uniqueIndex:idx_msgs_client,priority:3"`
+	ReplyTo         *uint      `json:"reply_to,omitempty"`
+	ThreadId        *uint      `json:"thread_id,omitempty" gorm:"index"`
+	Mentions        []int      `json:"mentions,omitempty" gorm:"serializer:json;type:text"`
+	MentionAll      bool       `json:"mention_all,omitempty" gorm:"not null;default:false"`
+	ForwardFrom     *uint      `json:"forward_from,omitempty"` // 转发的原始消息，多次转发时仍指向最初的消息
+	ForwardUserId   int        `json:"forward_user_id,omitempty" gorm:"not null;default:0"`
+	ForwardUserName string     `json:"forward_user_name,omitempty" gorm:"-"`
+	Edited          bool       `json:"edited" gorm:"not null;default:false"`
+	EditedAt        *Timestamp `json:"edited_at"`
+	Deleted         bool       `json:"deleted" gorm:"not null;default:false"`
+	DeletedAt       *Timestamp `json:"deleted_at"`
+	DeletedBy       int        `json:"deleted_by,omitempty" gorm:"not null;default:0"`
+	User            User       `gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type MsgEdit struct {
+	ID       uint      `json:"id" gorm:"primaryKey;auto_increment"`
+	MsgId    uint      `json:"msg_id" gorm:"not null;index"`
 	Text     string    `json:"text" gorm:"not null"`
-	Type     int       `json:"type" gorm:"not null"`
-	User     User      `gorm:"constraint:OnDelete:CASCADE;"`
+	EditedAt Timestamp `json:"edited_at" gorm:"not null"`
+	Msg      Msg       `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type Mention struct {
+	ID        uint      `json:"id" gorm:"primaryKey;auto_increment"`
+	MsgId     uint      `json:"msg_id" gorm:"not null;index"`
+	ConvId    int       `json:"conv_id" gorm:"not null"`
+	UserId    int       `json:"user_id" gorm:"not null;index:idx_mentions_unread,priority:1"`
+	Read      bool      `json:"read" gorm:"not null;default:false;index:idx_mentions_unread,priority:2"`
+	CreatedAt Timestamp `json:"created_at"`
+	Msg       Msg       `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	User      User      `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type Reaction struct {
+	MsgId     uint      `json:"msg_id" gorm:"primaryKey;autoIncrement:false"`
+	UserId    int       `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	Emoji     string    `json:"emoji" gorm:"primaryKey;size:32"`
+	CreatedAt Timestamp `json:"created_at"`
+	Msg       Msg       `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+	User      User      `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type ConvSetting struct {
+	ConvId           int    `json:"conv_id" gorm:"primaryKey;autoIncrement:false"`
+	AllowedReactions string `json:"-" gorm:"not null;default:''"`
+	PinLimit         int    `json:"pin_limit" gorm:"not null;default:0"`
+	SlowMode         int    `json:"slow_mode" gorm:"not null;default:0"` // 秒，0 表示关闭
+}
+
+type Pin struct {
+	ConvId   int       `json:"conv_id" gorm:"primaryKey;autoIncrement:false"`
+	MsgId    uint      `json:"msg_id" gorm:"primaryKey;autoIncrement:false"`
+	PinnedBy int       `json:"pinned_by" gorm:"not null"`
+	PinnedAt Timestamp `json:"pinned_at" gorm:"autoCreateTime"`
+	Msg      Msg       `json:"-" gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type ConvSeq struct {
+	ConvId int    `gorm:"primaryKey;autoIncrement:false"`
+	Seq    uint64 `gorm:"not null"`
+}
+
+type Migration struct {
+	Name      string    `gorm:"primaryKey;size:64"`
+	AppliedAt Timestamp `gorm:"autoCreateTime"`
 }
 
 type Group struct {
@@ -51,11 +122,38 @@ type GroupMember struct {
 	UserId  int `json:"user_id"`
 }
 
+type DirectConv struct {
+	ConvId int  `json:"conv_id" gorm:"primaryKey;autoIncrement:false"`
+	UserId int  `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	PeerId int  `json:"peer_id" gorm:"not null"`
+	User   User `gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+type ConvRead struct {
+	ConvId     int       `json:"conv_id" gorm:"primaryKey;autoIncrement:false"`
+	UserId     int       `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	LastReadId uint      `json:"last_read_id" gorm:"not null"`
+	ReadAt     Timestamp `json:"read_at"`
+	User       User      `gorm:"constraint:OnDelete:CASCADE;"`
+}
+
+// ReadAdvance 记录私聊已读游标每次前进的位置与时间，
+// 回执中某条消息的已读时间是游标首次越过它的时间
+type ReadAdvance struct {
+	ID     uint      `json:"id" gorm:"primaryKey"`
+	ConvId int       `json:"conv_id" gorm:"not null;index:idx_read_advances,priority:1"`
+	UserId int       `json:"user_id" gorm:"not null;index:idx_read_advances,priority:2"`
+	UpToId uint      `json:"up_to_id" gorm:"not null;index:idx_read_advances,priority:3"`
+	ReadAt Timestamp `json:"read_at"`
+	User   User      `gorm:"constraint:OnDelete:CASCADE;"`
+}
+
 type File struct {
 	UUID         string `json:"uuid" gorm:"primaryKey;size:36"`
 	OriginalName string `json:"original_name" gorm:"not null"`
 	Type         int    `json:"type" gorm:"not null"`
 	Size         int64  `json:"size" gorm:"not null"`
+	Mime         string `json:"mime" gorm:"size:127;not null;default:''"`
 	UserId       int    `json:"user_id"`
 	User         User   `gorm:"constraint:OnDelete:CASCADE;"`
 }
@@ -69,7 +167,7 @@ const (
 )
 
 func initDb() {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=UTC",
 		dbUser, dbPass, dbHost, dbPort, dbName,
 	)
 
@@ -89,19 +187,253 @@ func initDb() {
 			},
 		),
 		TranslateError: true,
+		NowFunc: func() time.Time {
+			return utcNow().Time
+		},
 	})
 	if err != nil {
 		log.Fatal("[err]", err)
 	}
 
+	err = runMigrations()
+	if err != nil {
+		log.Fatal("[err]", err)
+	}
+
+	if dropMsgUserName && db.Migrator().HasColumn("msgs", "user_name") {
+		err = db.Migrator().DropColumn("msgs", "user_name")
+		if err != nil {
+			log.Fatal("[err]", err)
+		}
+	}
+
 	err = db.AutoMigrate(
 		&User{},
 		&Session{},
 		&Msg{},
 		&Group{},
 		&File{},
+		&DirectConv{},
+		&ConvRead{},
+		&ReadAdvance{},
+		&ConvSeq{},
+		&MsgEdit{},
+		&Reaction{},
+		&ConvSetting{},
+		&Mention{},
+		&Pin{},
 	)
 	if err != nil {
 		log.Fatal("[err]", err)
 	}
 }
+
+// migrations 在 AutoMigrate 之前按顺序执行，每项只执行一次
+var migrations = []struct {
+	name string
+	fn   func(tx *gorm.DB) error
+}{
+	{"msg_seq", migrateMsgSeq},
+	{"msg_file_id", migrateMsgFile},
+	{"msg_user_name_nullable", migrateMsgUserName},
+	{"utc_timestamps", migrateUTC},
+	{"direct_convs_from_senders", migrateDirectConvs},
+}
+
+func runMigrations() error {
+	err := db.AutoMigrate(&Migration{})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		var count int64
+		err = db.Model(&Migration{}).Where("name = ?", m.name).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := m.fn(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Create(&Migration{Name: m.name}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateMsgSeq 按时间为已有消息补齐会话内序号，需先于唯一索引创建
+func migrateMsgSeq(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&Msg{}) {
+		return nil
+	}
+
+	if !tx.Migrator().HasColumn(&Msg{}, "Seq") {
+		err := tx.Migrator().AddColumn(&Msg{}, "Seq")
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Exec(`UPDATE msgs JOIN (
+		SELECT id, ROW_NUMBER() OVER (PARTITION BY conv_id ORDER BY time, id) AS rn FROM msgs
+	) r ON msgs.id = r.id SET msgs.seq = r.rn`).Error
+	if err != nil {
+		return err
+	}
+
+	err = tx.AutoMigrate(&ConvSeq{})
+	if err != nil {
+		return err
+	}
+
+	return tx.Exec(`INSERT INTO conv_seqs (conv_id, seq)
+		SELECT conv_id, MAX(seq) FROM msgs GROUP BY conv_id`).Error
+}
+
+// migrateMsgFile 为旧的图片与文件消息补齐附件引用，文本以附件 uuid 开头
+func migrateMsgFile(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&Msg{}) || !tx.Migrator().HasTable(&File{}) {
+		return nil
+	}
+
+	if !tx.Migrator().HasColumn(&Msg{}, "FileId") {
+		err := tx.Migrator().AddColumn(&Msg{}, "FileId")
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Exec(`UPDATE msgs SET file_id = SUBSTR(text, 1, 36)
+		WHERE type IN ? AND file_id IS NULL
+		AND SUBSTR(text, 1, 36) IN (SELECT uuid FROM files)`, []int{msgImage, msgFile}).Error
+}
+
+// migrateMsgUserName 发送者名称改为读取时解析，旧列不再写入，
+// 先允许为空以保留历史数据，设置 MOMO_DROP_MSG_USER_NAME 后删除
+func migrateMsgUserName(tx *gorm.DB) error {
+	if !tx.Migrator().HasColumn("msgs", "user_name") {
+		return nil
+	}
+	return tx.Exec("ALTER TABLE msgs MODIFY user_name longtext NULL").Error
+}
+
+// localTimeColumns 是切换到 UTC 之前以服务器本地时间写入的列
+var localTimeColumns = map[string][]string{
+	"msgs":       {"time", "edited_at", "deleted_at"},
+	"msg_edits":  {"edited_at"},
+	"sessions":   {"expires_at"},
+	"users":      {"last_seen"},
+	"conv_reads": {"read_at"},
+	"mentions":   {"created_at"},
+	"reactions":  {"created_at"},
+	"pins":       {"pinned_at"},
+}
+
+// migrateUTC 将本地时间转换为 UTC 并删除 fmt_time。按迁移时的时区偏移换算，
+// 服务器所在时区有夏令时的，跨越切换时刻的数据会有一小时偏差
+func migrateUTC(tx *gorm.DB) error {
+	if tx.Migrator().HasColumn("msgs", "fmt_time") {
+		err := tx.Exec(`UPDATE msgs SET time = STR_TO_DATE(fmt_time, '%Y-%m-%d %H:%i:%s')
+			WHERE time IS NULL AND fmt_time <> ''`).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	offset := time.Now().Format("-07:00")
+	if offset != "+00:00" {
+		for table, columns := range localTimeColumns {
+			for _, column := range columns {
+				if !tx.Migrator().HasColumn(table, column) {
+					continue
+				}
+				err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = CONVERT_TZ(%s, ?, '+00:00') WHERE %s IS NOT NULL",
+					table, column, column, column), offset).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if tx.Migrator().HasColumn("msgs", "fmt_time") {
+		return tx.Migrator().DropColumn("msgs", "fmt_time")
+	}
+	return nil
+}
+
+// migrateDirectConvs 按消息发送者为已有私聊补齐双方的 direct_convs 记录。
+// 双方都发过言时直接取两个发送者；只有一方发言时由 directPeers 推算另一方，
+// 候选唯一时才写入。发送者多于两人说明会话 ID 冲突，跳过并记录日志
+func migrateDirectConvs(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&Msg{}) {
+		return nil
+	}
+	err := tx.AutoMigrate(&DirectConv{})
+	if err != nil {
+		return err
+	}
+
+	var senders []struct {
+		ConvId int
+		UserId int
+	}
+	err = tx.Model(&Msg{}).
+		Distinct("conv_id", "user_id").
+		Where("conv_id NOT BETWEEN ? AND ?", 100000, 999999).
+		Scan(&senders).Error
+	if err != nil {
+		return err
+	}
+
+	byConv := make(map[int][]int)
+	for _, s := range senders {
+		byConv[s.ConvId] = append(byConv[s.ConvId], s.UserId)
+	}
+
+	var rows []DirectConv
+	for convId, userIds := range byConv {
+		var a, b int
+		switch len(userIds) {
+		case 1:
+			a = userIds[0]
+			var peers []int
+			err = tx.Model(&User{}).
+				Where("id IN ?", directPeers(convId, a)).
+				Pluck("id", &peers).Error
+			if err != nil {
+				return err
+			}
+			if len(peers) != 1 {
+				log.Printf("Direct conv %d: cannot resolve peer of user %d", convId, a)
+				continue
+			}
+			b = peers[0]
+		case 2:
+			a, b = userIds[0], userIds[1]
+			if generateConvId(a, b) != convId {
+				log.Printf("Direct conv %d: senders %d and %d do not match", convId, a, b)
+				continue
+			}
+		default:
+			log.Printf("Direct conv %d: %d senders, skipped", convId, len(userIds))
+			continue
+		}
+		rows = append(rows,
+			DirectConv{ConvId: convId, UserId: a, PeerId: b},
+			DirectConv{ConvId: convId, UserId: b, PeerId: a})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&rows, 500).Error
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// UserDirectory 缓存用户名称，构建历史与广播帧时按 user_id 解析发送者，
+// 改名后本实例立即生效，其他实例在 userCacheTTL 内生效
+type UserDirectory struct {
+	entries map[int]dirEntry
+	sync.RWMutex
+}
+
+type dirEntry struct {
+	name     string
+	loadedAt time.Time
+}
+
+var userDirectory = UserDirectory{
+	entries: make(map[int]dirEntry),
+}
+
+// names 批量解析用户名称，查询失败时记录日志并返回已缓存的部分
+func (d *UserDirectory) names(userIds []int) map[int]string {
+	names := make(map[int]string, len(userIds))
+	var missing []int
+	now := time.Now()
+
+	d.RLock()
+	for _, id := range userIds {
+		entry, ok := d.entries[id]
+		if ok && now.Sub(entry.loadedAt) < userCacheTTL {
+			names[id] = entry.name
+		} else if _, dup := names[id]; !dup {
+			names[id] = entry.name
+			missing = append(missing, id)
+		}
+	}
+	d.RUnlock()
+
+	if len(missing) == 0 {
+		return names
+	}
+
+	var users []User
+	err := db.Select("id", "name").Where("id IN ?", missing).Find(&users).Error
+	if err != nil {
+		log.Printf("User directory error: %v", err)
+		return names
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, id := range missing {
+		d.entries[id] = dirEntry{loadedAt: now}
+		names[id] = ""
+	}
+	for _, u := range users {
+		d.entries[u.ID] = dirEntry{name: u.Name, loadedAt: now}
+		names[u.ID] = u.Name
+	}
+	return names
+}
+
+func (d *UserDirectory) name(userId int) string {
+	return d.names([]int{userId})[userId]
+}
+
+func (d *UserDirectory) forget(userId int) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.entries, userId)
+}
+
+// fillSenderNames 为一批消息补齐发送者名称，转发的消息同时补齐原作者名称
+func fillSenderNames(msgs []Msg) {
+	userIds := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		userIds = append(userIds, m.UserId)
+		if m.ForwardUserId != 0 {
+			userIds = append(userIds, m.ForwardUserId)
+		}
+	}
+
+	names := userDirectory.names(userIds)
+	for i := range msgs {
+		msgs[i].UserName = names[msgs[i].UserId]
+		if msgs[i].ForwardUserId != 0 {
+			msgs[i].ForwardUserName = names[msgs[i].ForwardUserId]
+		}
+	}
+}
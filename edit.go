@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errEditExpired = &wsError{"edit_expired", "已超过可编辑时间"}
+
+// post /api/v1/message/:id/edit
+func msgEdit(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var request struct {
+		Text string `json:"text" binding:"required"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	msg, err := editMessage(userId, uint(msgId), 0, request.Text)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg_id":    msg.ID,
+		"edited_at": msg.EditedAt,
+	})
+}
+
+// get /api/v1/message/:id/edits
+func msgEditHistory(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var msg Msg
+	err = db.Select("id", "conv_id").First(&msg, "id = ?", msgId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			abortWithError(c, errMsgNotFound)
+		} else {
+			abortWithError(c, errInternal)
+		}
+		return
+	}
+
+	isOwner := false
+	if isGroupConv(msg.ConvId) {
+		isOwner, err = isGroupOwner(msg.ConvId, userId)
+		if err != nil {
+			abortWithError(c, errInternal)
+			return
+		}
+	}
+	if !isOwner {
+		abortWithError(c, errForbidden)
+		return
+	}
+
+	edits, err := msgEdits(msg.ID)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"edits": edits,
+	})
+}
+
+func processEdit(payload []byte, userId, convId int) (any, error) {
+	var request struct {
+		MsgId uint   `json:"msg_id"`
+		Text  string `json:"text"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil || request.MsgId == 0 {
+		return nil, errInvalidFrame
+	}
+
+	msg, err := editMessage(userId, request.MsgId, convId, request.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"msg_id":    msg.ID,
+		"edited_at": msg.EditedAt,
+	}, nil
+}
+
+// editMessage 修改作者本人在可编辑时间内的文本消息，旧内容写入编辑历史。
+// convId 非 0 时要求消息属于该会话
+func editMessage(userId int, msgId uint, convId int, text string) (Msg, error) {
+	text, err := cleanText(text)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	var msg Msg
+	err = db.First(&msg, "id = ?", msgId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Msg{}, errMsgNotFound
+		}
+		return Msg{}, errInternal
+	}
+
+	if msg.Deleted || convId != 0 && msg.ConvId != convId {
+		return Msg{}, errMsgNotFound
+	}
+	if msg.UserId != userId || msg.Type != msgText {
+		return Msg{}, errForbidden
+	}
+	if time.Since(msg.Time.Time) > editWindow {
+		return Msg{}, errEditExpired
+	}
+
+	isMember, err := isConvMember(msg.ConvId, userId)
+	if err != nil {
+		return Msg{}, errInternal
+	}
+	if !isMember {
+		return Msg{}, errNotMember
+	}
+
+	now := utcNow()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&MsgEdit{
+			MsgId:    msg.ID,
+			Text:     msg.Text,
+			EditedAt: now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&msg).Updates(map[string]interface{}{
+			"text":      text,
+			"edited":    true,
+			"edited_at": now,
+		}).Error
+	})
+	if err != nil {
+		return Msg{}, errInternal
+	}
+	msg.Text = text
+	msg.Edited = true
+	msg.EditedAt = &now
+	searcher.index(msg)
+
+	broadcast(msg.ConvId, "edited", gin.H{
+		"conv_id":   msg.ConvId,
+		"msg_id":    msg.ID,
+		"seq":       msg.Seq,
+		"text":      msg.Text,
+		"edited_at": msg.EditedAt,
+	})
+
+	return msg, nil
+}
+
+func msgEdits(msgId uint) ([]MsgEdit, error) {
+	var edits []MsgEdit
+	err := db.Where("msg_id = ?", msgId).
+		Order("id ASC").
+		Find(&edits).Error
+	return edits, err
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// exportBatch 是导出时每次从数据库读取的消息数，导出按批写出，不会一次读入整个会话
+const exportBatch = 500
+
+// exporter 将消息逐条写成一种导出格式
+type exporter interface {
+	begin(title string) error
+	write(m Msg, file *fileInfo) error
+	end() error
+}
+
+var exportFormats = map[string]struct {
+	ext         string
+	contentType string
+	create      func(w io.Writer, loc *time.Location, bundled bool) exporter
+}{
+	"jsonl": {"jsonl", "application/x-ndjson; charset=utf-8", newJsonlExporter},
+	"html":  {"html", "text/html; charset=utf-8", newHtmlExporter},
+	"text":  {"txt", "text/plain; charset=utf-8", newTextExporter},
+}
+
+// get /api/v1/conversations/:id/export
+func convExport(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+	if !isMember {
+		abortWithError(c, errNotMember)
+		return
+	}
+
+	format, ok := exportFormats[c.DefaultQuery("format", "jsonl")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "format 只能是 jsonl、html 或 text",
+		})
+		return
+	}
+
+	loc := userLocation(userId)
+	from, to, ok := timeRange(c, loc)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "时间格式无效",
+		})
+		return
+	}
+
+	bundled := false
+	switch c.Query("attachments") {
+	case "1", "true":
+		bundled = true
+	}
+
+	title, err := convTitle(convId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	name := fmt.Sprintf("conversation-%d.%s", convId, format.ext)
+	if bundled {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": fmt.Sprintf("conversation-%d.zip", convId),
+		}))
+	} else {
+		c.Header("Content-Type", format.contentType)
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": name,
+		}))
+	}
+	c.Status(http.StatusOK)
+
+	// 响应头发出后无法再返回错误状态，出错时只记录日志并截断输出
+	var out io.Writer = c.Writer
+	var archive *zip.Writer
+	if bundled {
+		archive = zip.NewWriter(c.Writer)
+		out, err = archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			log.Printf("Export error: %v", err)
+			return
+		}
+	}
+
+	buf := bufio.NewWriter(out)
+	files, err := exportConv(convId, title, from, to, format.create(buf, loc, bundled), func() error {
+		err := buf.Flush()
+		if err == nil && !bundled {
+			c.Writer.Flush()
+		}
+		return err
+	})
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		log.Printf("Export error: %v", err)
+		return
+	}
+
+	if bundled {
+		for _, file := range files {
+			err = bundleFile(archive, file)
+			if err != nil {
+				log.Printf("Export error: %v", err)
+				return
+			}
+		}
+
+		err = archive.Close()
+		if err != nil {
+			log.Printf("Export error: %v", err)
+		}
+	}
+}
+
+// exportConv 按 id 分批读取会话中未删除的消息并交给 exp，每批写完后调用 flush，
+// 返回导出消息引用的附件
+func exportConv(convId int, title string, from, to time.Time, exp exporter, flush func() error) ([]*fileInfo, error) {
+	var files []*fileInfo
+	seen := make(map[string]bool)
+
+	err := exp.begin(title)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Where("conv_id = ? AND deleted = ?", convId, false)
+	if !from.IsZero() {
+		query = query.Where("time >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("time < ?", to)
+	}
+	query = query.Session(&gorm.Session{})
+
+	var lastId uint
+	for {
+		var batch []Msg
+		err := query.Where("id > ?", lastId).
+			Order("id").
+			Limit(exportBatch).
+			Find(&batch).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		lastId = batch[len(batch)-1].ID
+
+		fillSenderNames(batch)
+		infos, err := filesOf(batch)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range batch {
+			var file *fileInfo
+			if m.FileId != nil {
+				file = infos[*m.FileId]
+			}
+			if file != nil && !seen[file.UUID] {
+				seen[file.UUID] = true
+				files = append(files, file)
+			}
+
+			err = exp.write(m, file)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = flush()
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) < exportBatch {
+			break
+		}
+	}
+
+	return files, exp.end()
+}
+
+// convTitle 返回导出文件中的会话名称：群聊为群名，私聊为对方的名称
+func convTitle(convId, userId int) (string, error) {
+	var name string
+	var err error
+	if isGroupConv(convId) {
+		err = db.Model(&Group{}).
+			Where("id = ?", convId).
+			Pluck("name", &name).Error
+	} else {
+		err = db.Model(&DirectConv{}).
+			Select("users.name").
+			Joins("JOIN users ON users.id = direct_convs.peer_id").
+			Where("direct_convs.conv_id = ? AND direct_convs.user_id = ?", convId, userId).
+			Pluck("users.name", &name).Error
+	}
+	return name, err
+}
+
+// bundleFile 将附件写入压缩包，源文件缺失时跳过
+func bundleFile(archive *zip.Writer, file *fileInfo) error {
+	src, err := os.Open(filepath.Join(uploadPath, file.UUID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Export skipped missing file: %s", file.UUID)
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	dst, err := archive.Create(bundledPath(file))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// bundledPath 是附件在压缩包中的路径，文件名去掉路径分隔符与控制字符
+func bundledPath(file *fileInfo) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, file.Name)
+	return "attachments/" + file.UUID + "_" + name
+}
+
+// exportText 是消息在 HTML 与纯文本导出中显示的内容
+func exportText(m Msg, file *fileInfo) string {
+	switch {
+	case file != nil:
+		kind := "[文件]"
+		switch m.Type {
+		case msgImage:
+			kind = "[图片]"
+		case msgAudio:
+			kind = "[语音]"
+		}
+		return fmt.Sprintf("%s %s (%dkb)", kind, file.Name, file.Size)
+	case m.FileId != nil:
+		return "[附件已失效]"
+	case m.Type == msgSticker:
+		return "[表情] " + m.Text
+	default:
+		return m.Text
+	}
+}
+
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func newJsonlExporter(w io.Writer, _ *time.Location, _ bool) exporter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonlExporter{enc: enc}
+}
+
+func (e *jsonlExporter) begin(string) error {
+	return nil
+}
+
+func (e *jsonlExporter) write(m Msg, file *fileInfo) error {
+	return e.enc.Encode(struct {
+		ID              uint       `json:"id"`
+		Seq             uint64     `json:"seq"`
+		Time            Timestamp  `json:"time"`
+		UserId          int        `json:"user_id"`
+		UserName        string     `json:"user_name"`
+		Type            int        `json:"type"`
+		Text            string     `json:"text"`
+		File            *fileInfo  `json:"file,omitempty"`
+		ReplyTo         *uint      `json:"reply_to,omitempty"`
+		ThreadId        *uint      `json:"thread_id,omitempty"`
+		ForwardFrom     *uint      `json:"forward_from,omitempty"`
+		ForwardUserId   int        `json:"forward_user_id,omitempty"`
+		ForwardUserName string     `json:"forward_user_name,omitempty"`
+		EditedAt        *Timestamp `json:"edited_at,omitempty"`
+	}{
+		m.ID, m.Seq, m.Time, m.UserId, m.UserName, m.Type, m.Text, file,
+		m.ReplyTo, m.ThreadId, m.ForwardFrom, m.ForwardUserId, m.ForwardUserName, m.EditedAt,
+	})
+}
+
+func (e *jsonlExporter) end() error {
+	return nil
+}
+
+type textExporter struct {
+	w   io.Writer
+	loc *time.Location
+}
+
+func newTextExporter(w io.Writer, loc *time.Location, _ bool) exporter {
+	return &textExporter{w: w, loc: loc}
+}
+
+func (e *textExporter) begin(title string) error {
+	_, err := fmt.Fprintf(e.w, "会话：%s\n导出时间：%s\n\n", title, utcNow().format(e.loc))
+	return err
+}
+
+// write 每条消息一行，多行消息的后续行缩进两格
+func (e *textExporter) write(m Msg, file *fileInfo) error {
+	var prefix string
+	if m.ForwardUserId != 0 {
+		prefix = fmt.Sprintf("[转发自 %s] ", m.ForwardUserName)
+	}
+	text := strings.ReplaceAll(exportText(m, file), "\n", "\n  ")
+	if m.Edited {
+		text += " (已编辑)"
+	}
+
+	_, err := fmt.Fprintf(e.w, "[%s] %s: %s%s\n", m.Time.format(e.loc), m.UserName, prefix, text)
+	return err
+}
+
+func (e *textExporter) end() error {
+	return nil
+}
+
+type htmlExporter struct {
+	w       io.Writer
+	loc     *time.Location
+	bundled bool
+}
+
+func newHtmlExporter(w io.Writer, loc *time.Location, bundled bool) exporter {
+	return &htmlExporter{w: w, loc: loc, bundled: bundled}
+}
+
+// htmlHead 内联全部样式，导出的文件不依赖任何外部资源
+const htmlHead = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: -apple-system, "PingFang SC", "Microsoft YaHei", sans-serif; max-width: 800px; margin: 0 auto; padding: 16px; color: #222; }
+header { border-bottom: 1px solid #ddd; margin-bottom: 16px; }
+header p { color: #888; font-size: 13px; }
+.msg { margin: 12px 0; }
+.meta { font-size: 13px; color: #888; }
+.name { font-weight: bold; color: #333; margin-right: 8px; }
+.forward { font-size: 12px; color: #888; border-left: 3px solid #ddd; padding-left: 6px; margin-top: 4px; }
+.text { white-space: pre-wrap; word-break: break-word; margin-top: 4px; }
+.text img { max-width: 320px; display: block; }
+</style>
+</head>
+<body>
+<header><h1>%s</h1><p>导出时间：%s</p></header>
+`
+
+func (e *htmlExporter) begin(title string) error {
+	title = html.EscapeString(title)
+	_, err := fmt.Fprintf(e.w, htmlHead, title, title, utcNow().format(e.loc))
+	return err
+}
+
+func (e *htmlExporter) write(m Msg, file *fileInfo) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<div class="msg" id="msg-%d"><div class="meta"><span class="name">%s</span><time datetime="%s">%s</time>`,
+		m.ID, html.EscapeString(m.UserName), m.Time.UTC().Format(timestampLayout), m.Time.format(e.loc))
+	if m.Edited {
+		b.WriteString(" (已编辑)")
+	}
+	b.WriteString("</div>")
+
+	if m.ForwardUserId != 0 {
+		fmt.Fprintf(&b, `<div class="forward">转发自 %s</div>`, html.EscapeString(m.ForwardUserName))
+	}
+
+	text := html.EscapeString(exportText(m, file))
+	if file != nil && e.bundled {
+		href := html.EscapeString((&url.URL{Path: bundledPath(file)}).String())
+		if m.Type == msgImage {
+			text = fmt.Sprintf(`<a href="%s"><img src="%s" alt="%s"></a>`, href, href, html.EscapeString(file.Name))
+		} else {
+			text = fmt.Sprintf(`<a href="%s">%s</a>`, href, text)
+		}
+	}
+	fmt.Fprintf(&b, `<div class="text">%s</div></div>`+"\n", text)
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *htmlExporter) end() error {
+	_, err := io.WriteString(e.w, "</body>\n</html>\n")
+	return err
+}
@@ -63,12 +63,7 @@ func upFileHandler(c *gin.Context) {
 	}
 
 	mimeType := http.DetectContentType(buffer)
-	var fileType int
-	if strings.HasPrefix(mimeType, "image/") {
-		fileType = 1
-	} else {
-		fileType = 2
-	}
+	fileType := fileKindOf(mimeType)
 
 	safeName := uuid.New().String()
 	filePath := filepath.Join(uploadPath, safeName)
@@ -88,6 +83,7 @@ func upFileHandler(c *gin.Context) {
 		OriginalName: fileHeader.Filename,
 		Type:         fileType,
 		Size:         fileSize,
+		Mime:         mimeType,
 		UserId:       userId,
 	}
 
@@ -105,6 +101,7 @@ func upFileHandler(c *gin.Context) {
 		"size": fileSize,
 		"name": fileHeader.Filename,
 		"type": fileType,
+		"mime": mimeType,
 	})
 }
 
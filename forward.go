@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	maxForwardMsgs  = 50 // 单次转发的消息数上限
+	maxForwardConvs = 10 // 单次转发的目标会话数上限
+)
+
+var (
+	errForwardEmpty   = &wsError{"forward_empty", "未选择要转发的消息或目标会话"}
+	errForwardLimit   = &wsError{"forward_limit", "转发的消息或目标会话过多"}
+	errNotForwardable = &wsError{"not_forwardable", "系统消息不能转发"}
+)
+
+// forwardResult 是单个目标会话的转发结果，某个会话失败不影响其他会话
+type forwardResult struct {
+	ConvId     int      `json:"conv_id"`
+	MsgIds     []uint   `json:"msg_ids,omitempty"`
+	Error      *wsError `json:"error,omitempty"`
+	RetryAfter float64  `json:"retry_after,omitempty"`
+}
+
+// post /api/v1/message/forward
+func msgForward(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	var request struct {
+		MsgIds  []uint `json:"msg_ids" binding:"required"`
+		ConvIds []int  `json:"conv_ids" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	results, err := forwardMessages(userId, request.MsgIds, request.ConvIds, 0)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+	})
+}
+
+func processForward(payload []byte, userId, convId int) (any, error) {
+	var request struct {
+		MsgIds  []uint `json:"msg_ids"`
+		ConvIds []int  `json:"conv_ids"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, errInvalidFrame
+	}
+
+	results, err := forwardMessages(userId, request.MsgIds, request.ConvIds, convId)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"results": results,
+	}, nil
+}
+
+// forwardMessages 将消息按原顺序复制到每个目标会话，调用者须同时是来源与目标会话的成员。
+// 附件消息复用原有文件，不复制文件本身。convId 非 0 时要求消息都属于该会话
+func forwardMessages(userId int, msgIds []uint, convIds []int, convId int) ([]forwardResult, error) {
+	msgIds = compact(msgIds)
+	convIds = compact(convIds)
+	if len(msgIds) == 0 || len(convIds) == 0 {
+		return nil, errForwardEmpty
+	}
+	if len(msgIds) > maxForwardMsgs || len(convIds) > maxForwardConvs {
+		return nil, errForwardLimit
+	}
+
+	var sources []Msg
+	err := db.Where("id IN ?", msgIds).Order("id").Find(&sources).Error
+	if err != nil {
+		return nil, errInternal
+	}
+	if len(sources) != len(msgIds) {
+		return nil, errMsgNotFound
+	}
+
+	var sourceConvs []int
+	for _, m := range sources {
+		if m.Deleted || convId != 0 && m.ConvId != convId {
+			return nil, errMsgNotFound
+		}
+		if m.Type == msgSystem {
+			return nil, errNotForwardable
+		}
+		sourceConvs = append(sourceConvs, m.ConvId)
+	}
+
+	for _, id := range compact(append(sourceConvs, convIds...)) {
+		if id <= 0 {
+			return nil, errInvalidConv
+		}
+		isMember, err := isConvMember(id, userId)
+		if err != nil {
+			return nil, errInternal
+		}
+		if !isMember {
+			return nil, errNotMember
+		}
+	}
+
+	results := make([]forwardResult, len(convIds))
+	for i, target := range convIds {
+		results[i].ConvId = target
+
+		msgs, err := forwardTo(target, userId, sources)
+		if err != nil {
+			var wsErr *wsError
+			if !errors.As(err, &wsErr) {
+				wsErr = errInternal
+			}
+			results[i].Error = wsErr
+
+			var retryErr *retryError
+			if errors.As(err, &retryErr) {
+				results[i].RetryAfter = retryErr.retryAfterSeconds()
+			}
+			continue
+		}
+
+		for _, m := range msgs {
+			results[i].MsgIds = append(results[i].MsgIds, m.ID)
+			publishMessage(m, nil)
+		}
+	}
+	return results, nil
+}
+
+// forwardTo 在一个事务中保存转发到 convId 的全部消息，每个目标会话计一次发送频率
+func forwardTo(convId, userId int, sources []Msg) ([]Msg, error) {
+	err := checkSendRate(convId, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]Msg, len(sources))
+	for i, src := range sources {
+		origin, originUser := src.ID, src.UserId
+		if src.ForwardFrom != nil {
+			origin, originUser = *src.ForwardFrom, src.ForwardUserId
+		}
+
+		msgs[i] = Msg{
+			ConvId:        convId,
+			UserId:        userId,
+			Text:          src.Text,
+			Type:          src.Type,
+			FileId:        src.FileId,
+			ForwardFrom:   &origin,
+			ForwardUserId: originUser,
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i := range msgs {
+			seq, err := nextSeq(tx, convId)
+			if err != nil {
+				return err
+			}
+			msgs[i].Seq = seq
+
+			err = tx.Create(&msgs[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Forward save failed: %v", err)
+		return nil, errInternal
+	}
+	return msgs, nil
+}
+
+// compact 去重并保持原有顺序
+func compact[T comparable](ids []T) []T {
+	var unique []T
+	for _, id := range ids {
+		if !slices.Contains(unique, id) {
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
@@ -48,13 +48,10 @@ func groupMember(c *gin.Context) {
 		return
 	}
 
-	var users []struct {
-		ID   int    `json:"id"`
-		Name string `json:"name"`
-	}
+	var users []User
 
 	err = db.Model(&GroupMember{}).
-		Select("users.id, users.name").
+		Select("users.id, users.name, users.last_seen, users.hide_last_seen").
 		Joins("JOIN users ON group_members.user_id = users.id").
 		Where("group_members.group_id = ?", groupId).
 		Scan(&users).Error
@@ -66,7 +63,7 @@ func groupMember(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"users": users,
+		"users": withPresence(users),
 	})
 }
 
@@ -272,6 +269,18 @@ func memberLeave(c *gin.Context) {
 		return
 	}
 
+	// 群主退出会解散群组，所有成员都失去订阅
+	revoked := []int{userId}
+	if group.OwnerId == userId {
+		revoked, err = convMemberIds(groupId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "退出群组失败",
+			})
+			return
+		}
+	}
+
 	err = db.Transaction(func(tx *gorm.DB) error {
 		if group.OwnerId == userId {
 			err = tx.Delete(&Group{}, "id = ?", groupId).Error
@@ -283,6 +292,11 @@ func memberLeave(c *gin.Context) {
 			if err != nil {
 				return err
 			}
+
+			err = tx.Delete(&ConvSetting{}, "conv_id = ?", groupId).Error
+			if err != nil {
+				return err
+			}
 		} else {
 			result := tx.Delete(&GroupMember{}, "group_id = ? AND user_id = ?", groupId, userId)
 
@@ -309,6 +323,8 @@ func memberLeave(c *gin.Context) {
 		return
 	}
 
+	revokeMembership(groupId, revoked)
+
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "退出群组成功",
 	})
@@ -372,7 +388,17 @@ func memberRemove(c *gin.Context) {
 		return
 	}
 
+	revokeMembership(groupId, []int{memberId})
+
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "移除群员成功",
 	})
 }
+
+func isGroupOwner(groupId, userId int) (bool, error) {
+	var count int64
+	err := db.Model(&Group{}).
+		Where("id = ? AND owner_id = ?", groupId, userId).
+		Count(&count).Error
+	return count > 0, err
+}
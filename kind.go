@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// 消息类型，图片、文件与语音引用发送者上传的附件，系统消息只能由服务端生成
+const (
+	msgText    = 0
+	msgImage   = 1
+	msgFile    = 2
+	msgAudio   = 3
+	msgSystem  = 4
+	msgSticker = 5
+)
+
+const uuidLen = 36
+
+var (
+	errInvalidKind    = &wsError{"invalid_kind", "消息类型无效"}
+	errFileNotFound   = &wsError{"file_not_found", "附件不存在"}
+	errFileMismatch   = &wsError{"file_mismatch", "附件类型与消息类型不符"}
+	errInvalidSticker = &wsError{"invalid_sticker", "表情包无效"}
+)
+
+// stickerPattern 匹配 pack/name 形式的表情包标识
+var stickerPattern = regexp.MustCompile(`^[\w-]{1,32}/[\w-]{1,32}$`)
+
+type fileInfo struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Mime string `json:"mime"`
+}
+
+func isFileKind(kind int) bool {
+	return kind == msgImage || kind == msgFile || kind == msgAudio
+}
+
+// fileKindOf 根据 MIME 类型决定上传文件对应的消息类型
+func fileKindOf(mime string) int {
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		return msgImage
+	case strings.HasPrefix(mime, "audio/"):
+		return msgAudio
+	default:
+		return msgFile
+	}
+}
+
+// validateKind 按消息类型校验内容，附件类消息的文本由附件元数据生成，
+// 兼容旧客户端在 text 中以 uuid.size.name 传递附件
+func validateKind(kind int, text, fileId string, userId int) (string, *string, error) {
+	switch {
+	case kind == msgText:
+		if fileId != "" {
+			return "", nil, errInvalidKind
+		}
+		text, err := cleanText(text)
+		return text, nil, err
+	case kind == msgSticker:
+		if !stickerPattern.MatchString(text) || fileId != "" {
+			return "", nil, errInvalidSticker
+		}
+		return text, nil, nil
+	case isFileKind(kind):
+		if fileId == "" && len(text) >= uuidLen {
+			fileId = text[:uuidLen]
+		}
+		if fileId == "" {
+			return "", nil, errFileNotFound
+		}
+
+		var file File
+		err := db.First(&file, "uuid = ?", fileId).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return "", nil, errFileNotFound
+			}
+			return "", nil, errInternal
+		}
+		if file.UserId != userId {
+			return "", nil, errFileNotFound
+		}
+		if kind != msgFile && file.Type != kind {
+			return "", nil, errFileMismatch
+		}
+
+		return fileText(file), &file.UUID, nil
+	default:
+		return "", nil, errInvalidKind
+	}
+}
+
+// fileText 生成附件消息的文本，保持旧客户端使用的 uuid.size.name 格式
+func fileText(file File) string {
+	return fmt.Sprintf("%s.%dkb.%s", file.UUID, file.Size, file.OriginalName)
+}
+
+// filesOf 批量读取消息引用的附件元数据
+func filesOf(msgs []Msg) (map[string]*fileInfo, error) {
+	var uuids []string
+	for _, m := range msgs {
+		if m.FileId != nil {
+			uuids = append(uuids, *m.FileId)
+		}
+	}
+
+	infos := make(map[string]*fileInfo, len(uuids))
+	if len(uuids) == 0 {
+		return infos, nil
+	}
+
+	var files []File
+	err := db.Where("uuid IN ?", uuids).Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		infos[f.UUID] = &fileInfo{
+			UUID: f.UUID,
+			Name: f.OriginalName,
+			Size: f.Size,
+			Mime: f.Mime,
+		}
+	}
+	return infos, nil
+}
@@ -15,6 +15,8 @@ import (
 
 func main() {
 	initDb()
+	initSearch()
+	initBroker()
 	initDir()
 	run()
 }
@@ -42,17 +44,44 @@ func run() {
 
 	v1 := r.Group("api/v1")
 	v1.Use(AuthorizationMiddleware())
+	v1.GET("/ws/user", userSocketHandler)
 	v1.GET("/ws/message", messageHandler)
 	v1.GET("/ws/convid", convIdHandler)
 	v1.POST("/upload", upFileHandler)
 	v1.GET("/files/:filename", downFileHandler)
 
+	conv := v1.Group("conversations")
+	conv.GET("", conversationList)
+	conv.GET("/unread", convUnread)
+	conv.POST("/:id/read", convRead)
+	conv.GET("/:id/settings", convSettingInfo)
+	conv.POST("/:id/settings", convSettingUpdate)
+	conv.GET("/:id/pins", convPins)
+	conv.GET("/:id/export", convExport)
+
+	v1.GET("/mentions", mentionList)
+	v1.GET("/search", msgSearch)
+
+	message := v1.Group("message")
+	message.POST("/forward", msgForward)
+	message.GET("/:id/receipt", msgReceipt)
+	message.GET("/:id/edits", msgEditHistory)
+	message.GET("/:id/thread", msgThread)
+	message.POST("/:id/edit", msgEdit)
+	message.POST("/:id/recall", msgRecall)
+	message.POST("/:id/delete", msgDelete)
+	message.POST("/:id/react", msgReact)
+	message.POST("/:id/pin", msgPin)
+	message.POST("/:id/unpin", msgUnpin)
+
 	user := v1.Group("user")
 	user.GET("/info/me", userOwnInfo)
 	user.GET("/lists", userList)
 	user.GET("/logout", userLogout)
 	user.POST("/rename", resetName)
 	user.POST("/repassword", resetPassword)
+	user.POST("/privacy", resetPrivacy)
+	user.POST("/timezone", resetTimeZone)
 
 	group := v1.Group("group")
 	group.GET("/lists", groupListAsMember)
@@ -86,6 +115,13 @@ func run() {
 		log.Fatal("[err]", err)
 	}
 
+	presenceTracker.flush()
+
+	err = broker.Close()
+	if err != nil {
+		log.Printf("Broker close error: %v", err)
+	}
+
 	_db, err := db.DB()
 	if err != nil {
 		log.Fatal("[err]", err)
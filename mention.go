@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	mentionPattern = regexp.MustCompile(`@(all\b|\d+)`)
+
+	errMentionAll = &wsError{"mention_all_forbidden", "只有群主可以 @全体成员"}
+)
+
+// parseMentions 解析群消息中的 @<用户 ID> 与 @all，只保留群成员
+func parseMentions(text string, userId, convId int) ([]int, bool, error) {
+	if !isGroupConv(convId) {
+		return nil, false, nil
+	}
+
+	matches := mentionPattern.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return nil, false, nil
+	}
+
+	all := false
+	var candidates []int
+	for _, m := range matches {
+		if m[1] == "all" {
+			all = true
+			continue
+		}
+		id, err := strconv.Atoi(m[1])
+		if err == nil && id != userId && !slices.Contains(candidates, id) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	if all {
+		isOwner, err := isGroupOwner(convId, userId)
+		if err != nil {
+			return nil, false, errInternal
+		}
+		if !isOwner {
+			return nil, false, errMentionAll
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, all, nil
+	}
+
+	var members []int
+	err := db.Model(&GroupMember{}).
+		Where("group_id = ? AND user_id IN ?", convId, candidates).
+		Pluck("user_id", &members).Error
+	if err != nil {
+		return nil, false, errInternal
+	}
+
+	// 保持消息中出现的顺序
+	mentioned := slices.DeleteFunc(candidates, func(id int) bool {
+		return !slices.Contains(members, id)
+	})
+	return mentioned, all, nil
+}
+
+// createMentions 在消息保存的事务中为被提及的用户写入提醒记录
+func createMentions(tx *gorm.DB, msg Msg) ([]int, error) {
+	userIds := msg.Mentions
+	if msg.MentionAll {
+		err := tx.Model(&GroupMember{}).
+			Where("group_id = ? AND user_id <> ?", msg.ConvId, msg.UserId).
+			Pluck("user_id", &userIds).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(userIds) == 0 {
+		return nil, nil
+	}
+
+	mentions := make([]Mention, len(userIds))
+	for i, uid := range userIds {
+		mentions[i] = Mention{
+			MsgId:  msg.ID,
+			ConvId: msg.ConvId,
+			UserId: uid,
+		}
+	}
+	return userIds, tx.Create(&mentions).Error
+}
+
+func notifyMentions(userIds []int, msg Msg) {
+	event := gin.H{
+		"conv_id": msg.ConvId,
+		"message": previewOf(msg),
+	}
+	for _, uid := range userIds {
+		sendToUser(uid, "mention", event)
+	}
+}
+
+// markMentionsRead 已读游标越过的提醒一并标为已读
+func markMentionsRead(convId, userId int, msgId uint) {
+	err := db.Model(&Mention{}).
+		Where("conv_id = ? AND user_id = ? AND msg_id <= ? AND `read` = ?", convId, userId, msgId, false).
+		Update("read", true).Error
+	if err != nil {
+		log.Printf("Mark mentions error: %v", err)
+	}
+}
+
+// get /api/v1/mentions
+func mentionList(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+	page, size := pagination(c)
+
+	// 退出或被移出的群不再展示，避免借提醒读取新消息
+	query := db.Model(&Mention{}).
+		Where("user_id = ? AND `read` = ?", userId, false).
+		Where("conv_id IN (?)", db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)).
+		Session(&gorm.Session{})
+
+	var total int64
+	err := query.Count(&total).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索提醒失败",
+		})
+		return
+	}
+
+	var mentions []Mention
+	err = query.Preload("Msg").
+		Order("id DESC").
+		Offset((page - 1) * size).
+		Limit(size).
+		Find(&mentions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索提醒失败",
+		})
+		return
+	}
+
+	list := make([]gin.H, len(mentions))
+	for i, m := range mentions {
+		list[i] = gin.H{
+			"id":      m.ID,
+			"conv_id": m.ConvId,
+			"message": previewOf(m.Msg),
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mentions": list,
+		"total":    total,
+		"page":     page,
+	})
+}
@@ -2,33 +2,125 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{protoV2Name},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
 type WsClientManager struct {
-	clients map[int]map[*websocket.Conn]bool
+	clients map[int]map[*wsClient]bool
+	users   map[int]map[*wsClient]bool
 	sync.RWMutex
 }
 
 var clientManager = WsClientManager{
-	clients: make(map[int]map[*websocket.Conn]bool),
+	clients: make(map[int]map[*wsClient]bool),
+	users:   make(map[int]map[*wsClient]bool),
+}
+
+type wsClient struct {
+	conn   *websocket.Conn
+	userId int
+	convId int  // 单会话连接绑定的会话
+	mux    bool // 多路复用连接，接收所有会话的新消息通知
+	proto  int
+	subs   map[int]bool // 由 clientManager 的锁保护
+
+	out       chan any // 发送队列，由唯一的写协程消费
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu        sync.Mutex
+	replays   map[int][]bufferedFrame // 补发历史期间缓存的实时帧，由 mu 保护
+	replaying bool                    // 读协程正在补发历史，由 mu 保护
+	pending   []any                   // 补发期间其他协程投递的帧，补发结束后由读协程写出
+}
+
+type bufferedFrame struct {
+	op      string
+	payload any
+}
+
+func newWsClient(ws *websocket.Conn, userId int) *wsClient {
+	cl := &wsClient{
+		conn:    ws,
+		userId:  userId,
+		proto:   negotiateProto(ws),
+		subs:    make(map[int]bool),
+		out:     make(chan any, sendQueueSize),
+		done:    make(chan struct{}),
+		replays: make(map[int][]bufferedFrame),
+	}
+	ws.SetReadLimit(int64(maxFrameSize) * frameHardLimit)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go cl.writePump()
+	return cl
+}
+
+func (m *WsClientManager) subscribe(cl *wsClient, convId int) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.clients[convId] == nil {
+		m.clients[convId] = make(map[*wsClient]bool)
+	}
+	m.clients[convId][cl] = true
+	cl.subs[convId] = true
+}
+
+func (m *WsClientManager) unsubscribe(cl *wsClient, convId int) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if !cl.subs[convId] {
+		return false
+	}
+	delete(cl.subs, convId)
+	delete(m.clients[convId], cl)
+	if len(m.clients[convId]) == 0 {
+		delete(m.clients, convId)
+	}
+	return true
+}
+
+func (m *WsClientManager) subscribed(cl *wsClient, convId int) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return cl.subs[convId]
+}
+
+func (m *WsClientManager) subscriptions(cl *wsClient) []int {
+	m.RLock()
+	defer m.RUnlock()
+
+	convIds := make([]int, 0, len(cl.subs))
+	for convId := range cl.subs {
+		convIds = append(convIds, convId)
+	}
+	return convIds
 }
 
 // ws /api/v1/ws/message
@@ -51,6 +143,32 @@ func messageHandler(c *gin.Context) {
 		return
 	}
 
+	since, err := strconv.ParseUint(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "since 必须是整数",
+		})
+		return
+	}
+
+	sinceSeq, err := strconv.ParseUint(c.DefaultQuery("since_seq", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "since_seq 必须是整数",
+		})
+		return
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+	if !isMember {
+		abortWithError(c, errNotMember)
+		return
+	}
+
 	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -59,106 +177,359 @@ func messageHandler(c *gin.Context) {
 		return
 	}
 
-	clientManager.Lock()
-	if clientManager.clients[convId] == nil {
-		clientManager.clients[convId] = make(map[*websocket.Conn]bool)
-	}
-	clientManager.clients[convId][ws] = true
-	clientManager.Unlock()
+	client := newWsClient(ws, userId)
+	client.convId = convId
+	trackConn(client)
 
 	defer func() {
-		clientManager.Lock()
-		delete(clientManager.clients[convId], ws)
-		if len(clientManager.clients[convId]) == 0 {
-			delete(clientManager.clients, convId)
-		}
-		clientManager.Unlock()
-		ws.Close()
+		leaveConv(client, convId)
+		untrackConn(client)
+		client.close()
 	}()
 
-	err = sendHistoricalMessages(ws, convId)
+	client.hello()
+
+	err = sendHistoricalMessages(client, convId, uint(since), sinceSeq)
 	if err != nil {
 		log.Printf("Error sending history: %v", err)
 	}
 
-	for {
-		_, message, err := ws.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-				log.Printf("WebSocket error: %v", err)
+	err = readUpTo(convId, userId, 0)
+	if err != nil {
+		log.Printf("Error marking read: %v", err)
+	}
+
+	serveClient(client)
+}
+
+// leaveConv 在连接不再关注会话时结束输入状态并推进已读
+func leaveConv(cl *wsClient, convId int) {
+	if !clientManager.unsubscribe(cl, convId) {
+		return
+	}
+
+	typingTracker.stop(convId, cl.userId)
+
+	err := readUpTo(convId, cl.userId, 0)
+	if err != nil {
+		log.Printf("Error marking read: %v", err)
+	}
+}
+
+// sendHistoricalMessages 订阅会话并补发 since 之后的消息，再切换到实时推送。
+// 补发期间到达的实时帧先缓存，补发结束后剔除已发送过的消息再依次下发。
+// 其他协程在此期间投递的帧同样暂存，历史由读协程阻塞写入队列，不会触发溢出断开
+func sendHistoricalMessages(cl *wsClient, convId int, since uint, sinceSeq uint64) error {
+	// 补发在读协程上进行，期间到达的 pong 要等下次读取才处理，
+	// 结束后延长读超时，避免补发较久时下次读取直接超时
+	defer cl.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+	cl.mu.Lock()
+	cl.replays[convId] = []bufferedFrame{}
+	cl.replaying = true
+	cl.mu.Unlock()
+
+	clientManager.subscribe(cl, convId)
+
+	sent := make(map[uint]bool)
+	var messages []Msg
+	err := resumeSeq(convId, since, &sinceSeq)
+	lastSeq := sinceSeq
+	if err == nil {
+		err = db.Where("conv_id = ? AND seq > ?", convId, sinceSeq).
+			Order("seq ASC").
+			Find(&messages).Error
+	}
+	var views []MsgView
+	if err == nil {
+		views, err = viewsOf(messages)
+	}
+	if err == nil {
+		for _, hisMsg := range views {
+			err = cl.write(cl.encode("history", hisMsg))
+			if err != nil {
+				err = fmt.Errorf("write error: %w", err)
+				break
 			}
-			break
+			sent[hisMsg.ID] = true
+			lastSeq = max(lastSeq, hisMsg.Seq)
 		}
+	} else {
+		err = fmt.Errorf("database error: %w", err)
+	}
 
-		err = processMessage(message, userId, convId)
-		if err != nil {
-			log.Printf("Message processing error: %v", err)
+	// 分批取出缓存帧，写出时不持有锁，避免阻塞其他会话的广播
+	for {
+		cl.mu.Lock()
+		buffered := cl.replays[convId]
+		if err != nil || len(buffered) == 0 {
+			delete(cl.replays, convId)
+			if err == nil {
+				// synced 排在暂存帧之后，之后的实时帧都在它后面
+				cl.pending = append(cl.pending, cl.encode("synced", gin.H{
+					"conv_id":  convId,
+					"last_seq": lastSeq,
+				}))
+			}
+			cl.mu.Unlock()
+			return errors.Join(err, cl.flushPending())
+		}
+		cl.replays[convId] = []bufferedFrame{}
+		cl.mu.Unlock()
+
+		for _, frame := range buffered {
+			if msg, ok := frameMsg(frame); ok {
+				if sent[msg.ID] {
+					continue
+				}
+				lastSeq = max(lastSeq, msg.Seq)
+			}
+			err = cl.write(cl.encode(frame.op, frame.payload))
+			if err != nil {
+				err = fmt.Errorf("write error: %w", err)
+				break
+			}
 		}
 	}
 }
 
-func sendHistoricalMessages(ws *websocket.Conn, convId int) error {
-	var messages []Msg
-	err := db.Where("conv_id = ?", convId).
-		Order("time ASC").
-		Find(&messages).Error
+// resumeSeq 将客户端给出的消息 ID 换算为序号，两者都给出时以序号为准
+func resumeSeq(convId int, since uint, sinceSeq *uint64) error {
+	if *sinceSeq > 0 || since == 0 {
+		return nil
+	}
+	return db.Model(&Msg{}).
+		Select("COALESCE(MAX(seq), 0)").
+		Where("conv_id = ? AND id <= ?", convId, since).
+		Scan(sinceSeq).Error
+}
+
+func frameMsg(frame bufferedFrame) (Msg, bool) {
+	if frame.op != "message" {
+		return Msg{}, false
+	}
+	view, ok := frame.payload.(MsgView)
+	return view.Msg, ok
+}
+
+// processMessage 保存并广播一条消息，携带 client_id 的重试返回已保存的消息
+func processMessage(payload []byte, userId, convId int) (Msg, bool, error) {
+	var msg struct {
+		Text     string `json:"text" binding:"required"`
+		Type     int    `json:"type"`
+		FileId   string `json:"file_id"`
+		ClientId string `json:"client_id"`
+		ReplyTo  uint   `json:"reply_to"`
+	}
+	err := json.Unmarshal(payload, &msg)
 	if err != nil {
-		return fmt.Errorf("database error: %w", err)
+		return Msg{}, false, errInvalidFrame
 	}
 
-	for _, hisMsg := range messages {
-		err = ws.WriteJSON(hisMsg)
+	if len(msg.ClientId) > maxClientIdLen {
+		return Msg{}, false, errInvalidClientId
+	}
+
+	var clientId *string
+	if msg.ClientId != "" {
+		clientId = &msg.ClientId
+
+		existing, found, err := findByClientId(convId, userId, msg.ClientId)
 		if err != nil {
-			return fmt.Errorf("write error: %w", err)
+			return Msg{}, false, errInternal
+		}
+		if found {
+			return existing, false, nil
 		}
 	}
 
-	return nil
-}
-
-func processMessage(message []byte, userId, convId int) error {
-	var msg struct {
-		Text string `json:"text" binding:"required"`
-		Type int    `json:"type"`
+	err = checkSendRate(convId, userId)
+	if err != nil {
+		return Msg{}, false, err
 	}
-	err := json.Unmarshal(message, &msg)
+
+	text, fileId, err := validateKind(msg.Type, msg.Text, msg.FileId, userId)
 	if err != nil {
-		return fmt.Errorf("invalid message format: %w", err)
+		return Msg{}, false, err
 	}
 
-	if strings.TrimSpace(msg.Text) == "" {
-		return fmt.Errorf("empty message content")
+	var replyTo, threadId *uint
+	if msg.ReplyTo != 0 {
+		replyTo, threadId, err = resolveReply(convId, msg.ReplyTo)
+		if err != nil {
+			return Msg{}, false, err
+		}
 	}
 
-	userName, _ := getNameById(&User{}, userId)
+	var mentions []int
+	var mentionAll bool
+	if msg.Type == msgText {
+		mentions, mentionAll, err = parseMentions(text, userId, convId)
+		if err != nil {
+			return Msg{}, false, err
+		}
+	}
 
 	newMsg := Msg{
-		ConvId:   convId,
-		UserId:   userId,
-		UserName: userName,
-		FmtTime:  time.Now().Format(time.DateTime),
-		Text:     msg.Text,
-		Type:     msg.Type,
+		ConvId:     convId,
+		UserId:     userId,
+		Text:       text,
+		Type:       msg.Type,
+		FileId:     fileId,
+		ClientId:   clientId,
+		ReplyTo:    replyTo,
+		ThreadId:   threadId,
+		Mentions:   mentions,
+		MentionAll: mentionAll,
 	}
 
-	err = db.Create(&newMsg).Error
+	var mentioned []int
+	err = db.Transaction(func(tx *gorm.DB) error {
+		seq, err := nextSeq(tx, convId)
+		if err != nil {
+			return err
+		}
+		newMsg.Seq = seq
+
+		err = tx.Create(&newMsg).Error
+		if err != nil {
+			return err
+		}
+
+		mentioned, err = createMentions(tx, newMsg)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("database save failed: %w", err)
+		// 并发重试时由唯一索引兜底
+		if clientId != nil && errors.Is(err, gorm.ErrDuplicatedKey) {
+			existing, found, err := findByClientId(convId, userId, msg.ClientId)
+			if err == nil && found {
+				return existing, false, nil
+			}
+		}
+		log.Printf("Database save failed: %v", err)
+		return Msg{}, false, errInternal
 	}
 
-	clientManager.RLock()
-	defer clientManager.RUnlock()
+	typingTracker.stop(convId, userId)
+	publishMessage(newMsg, mentioned)
 
-	for client := range clientManager.clients[convId] {
-		go func(conn *websocket.Conn) {
-			err = conn.WriteJSON(newMsg)
-			if err != nil {
-				log.Printf("Broadcast error: %v", err)
+	return newMsg, true, nil
+}
+
+// publishMessage 为已保存的消息建立索引并推送给会话成员与被提及的用户
+func publishMessage(msg Msg, mentioned []int) {
+	searcher.index(msg)
+
+	views, err := viewsOf([]Msg{msg})
+	if err != nil {
+		log.Printf("Message view error: %v", err)
+		views = []MsgView{{Msg: msg}}
+	}
+	broadcast(msg.ConvId, "message", views[0])
+	notifyMembers(msg.ConvId, msg)
+	notifyMentions(mentioned, msg)
+
+	if msg.ThreadId != nil {
+		broadcastThread(msg.ConvId, *msg.ThreadId)
+	}
+}
+
+// nextSeq 在事务内递增会话序号，计数行锁持有到提交，
+// 因此同一会话的序号按提交顺序严格递增
+func nextSeq(tx *gorm.DB, convId int) (uint64, error) {
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "conv_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"seq": gorm.Expr("seq + 1")}),
+	}).Create(&ConvSeq{ConvId: convId, Seq: 1}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var seq uint64
+	err = tx.Model(&ConvSeq{}).
+		Where("conv_id = ?", convId).
+		Pluck("seq", &seq).Error
+	return seq, err
+}
+
+func findByClientId(convId, userId int, clientId string) (Msg, bool, error) {
+	var msgs []Msg
+	err := db.Where("conv_id = ? AND user_id = ? AND client_id = ?", convId, userId, clientId).
+		Limit(1).
+		Find(&msgs).Error
+	if err != nil || len(msgs) == 0 {
+		return Msg{}, false, err
+	}
+	return msgs[0], true, nil
+}
+
+// broadcast 推送给所有实例上订阅该会话的连接
+func broadcast(convId int, op string, payload any) {
+	ev := brokerEvent{Kind: eventConv, ConvId: convId, Op: op, Payload: payload}
+	if view, ok := payload.(MsgView); ok && op == "message" {
+		ev.MsgId = view.ID
+	}
+	publish(ev)
+}
+
+// revokeMembership 在用户离开或被移出会话后断开其所有连接对该会话的订阅
+func revokeMembership(convId int, userIds []int) {
+	publish(brokerEvent{Kind: eventRevoke, ConvId: convId, UserIds: userIds})
+}
+
+// dropSubscriptions 让多路复用连接退订会话并通知客户端，
+// 绑定该会话的单会话连接直接断开
+func dropSubscriptions(convId int, userIds []int) {
+	var clients []*wsClient
+	clientManager.RLock()
+	for _, userId := range userIds {
+		for client := range clientManager.users[userId] {
+			if client.subs[convId] || client.convId == convId {
+				clients = append(clients, client)
 			}
-		}(client)
+		}
 	}
+	clientManager.RUnlock()
 
-	return nil
+	for _, client := range clients {
+		if !client.mux {
+			client.closeWith(websocket.ClosePolicyViolation, "not a member")
+			continue
+		}
+		if clientManager.unsubscribe(client, convId) {
+			typingTracker.stop(convId, client.userId)
+			client.send("unsubscribed", gin.H{
+				"conv_id": convId,
+				"reason":  errNotMember.Code,
+			})
+		}
+	}
+}
+
+func sendToUser(userId int, op string, payload any) {
+	publish(brokerEvent{Kind: eventUser, UserIds: []int{userId}, Op: op, Payload: payload})
+}
+
+// notifyMembers 向未订阅该会话的多路复用连接推送新消息通知
+func notifyMembers(convId int, msg Msg) {
+	memberIds, err := convMemberIds(convId)
+	if err != nil {
+		log.Printf("Notify error: %v", err)
+		return
+	}
+
+	publish(brokerEvent{
+		Kind:    eventNotify,
+		ConvId:  convId,
+		UserIds: memberIds,
+		Op:      "notify",
+		MsgId:   msg.ID,
+		Payload: gin.H{
+			"conv_id": convId,
+			"message": previewOf(msg),
+		},
+	})
 }
 
 // ws /api/v1/ws/convid
@@ -173,12 +544,23 @@ func convIdHandler(c *gin.Context) {
 		return
 	}
 
+	client := newWsClient(ws, userId)
+	trackConn(client)
+	defer func() {
+		untrackConn(client)
+		client.close()
+	}()
+
 	for {
-		_, message, err := ws.ReadMessage()
+		message, err := client.read()
+		if errors.Is(err, errFrameTooLarge) {
+			client.write(gin.H{
+				"error": errFrameTooLarge.Message,
+			})
+			continue
+		}
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-				log.Printf("WebSocket error: %v", err)
-			}
+			logReadError(client, err)
 			break
 		}
 
@@ -187,45 +569,74 @@ func convIdHandler(c *gin.Context) {
 		}
 		err = json.Unmarshal(message, &request)
 		if err != nil {
-			ws.WriteJSON(gin.H{
+			client.write(gin.H{
 				"error": "请求格式无效",
 			})
 			log.Printf("ConvId request error: %v", err)
 			continue
 		}
 
-		if request.TargetId <= 0 {
-			ws.WriteJSON(gin.H{
-				"error": "目标用户 ID 无效",
-			})
-			log.Printf("ConvId request error: invalid target user")
-			continue
-		}
-
-		var exists bool
-		err = db.Model(&User{}).
-			Select("count(*) > 0").
-			Where("id = ?", request.TargetId).
-			Find(&exists).Error
-		if err != nil || !exists {
-			ws.WriteJSON(gin.H{
-				"error": "目标用户 ID 不存在",
+		convId, err := resolveDirectConv(userId, request.TargetId)
+		if err != nil {
+			client.write(gin.H{
+				"error": err.Error(),
 			})
-			log.Printf("ConvId request error: user not found")
+			log.Printf("ConvId request error: %v", err)
 			continue
 		}
 
-		convId := generateConvId(userId, request.TargetId)
-
-		ws.WriteJSON(gin.H{
+		client.write(gin.H{
 			"conv_id": convId,
 		})
 	}
 }
 
+func resolveDirectConv(userId, targetId int) (int, error) {
+	if targetId <= 0 {
+		return 0, &wsError{"invalid_target", "目标用户 ID 无效"}
+	}
+
+	var exists bool
+	err := db.Model(&User{}).
+		Select("count(*) > 0").
+		Where("id = ?", targetId).
+		Find(&exists).Error
+	if err != nil || !exists {
+		return 0, &wsError{"invalid_target", "目标用户 ID 不存在"}
+	}
+
+	convId := generateConvId(userId, targetId)
+
+	err = ensureDirectConv(convId, userId, targetId)
+	if errors.Is(err, errConvConflict) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, &wsError{"internal", "创建会话失败"}
+	}
+
+	return convId, nil
+}
+
+// generateConvId 由双方 ID 生成私聊会话 ID，高 32 位与低 32 位分别取
+// 较小与较大 ID 的低 32 位。不同的两对用户可能得到同一个 ID，由 ensureDirectConv 拒绝
 func generateConvId(user1, user2 int) int {
 	if user1 > user2 {
 		user1, user2 = user2, user1
 	}
 	return (user1 << 32) | (user2 & 0xFFFFFFFF)
 }
+
+// directPeers 返回与 userId 组成会话 convId 的所有合法用户 ID
+func directPeers(convId, userId int) []int {
+	hi, lo := int(uint64(convId)>>32), convId&0xFFFFFFFF
+	var peers []int
+	for _, base := range []int{hi, lo} {
+		for id := base; id <= 19999999999; id += 1 << 32 {
+			if validateUserId(id) && generateConvId(userId, id) == convId && !slices.Contains(peers, id) {
+				peers = append(peers, id)
+			}
+		}
+	}
+	return peers
+}
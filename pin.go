@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errPinLimit = &wsError{"pin_limit", "置顶消息已达上限"}
+
+type pinView struct {
+	MsgView
+	PinnedBy int       `json:"pinned_by"`
+	PinnedAt Timestamp `json:"pinned_at"`
+}
+
+// get /api/v1/conversations/:id/pins
+func convPins(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+	if !isMember {
+		abortWithError(c, errNotMember)
+		return
+	}
+
+	var pins []Pin
+	err = db.Preload("Msg").
+		Where("conv_id = ?", convId).
+		Order("pinned_at DESC").
+		Find(&pins).Error
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	msgs := make([]Msg, len(pins))
+	for i, p := range pins {
+		msgs[i] = p.Msg
+	}
+	views, err := viewsOf(msgs)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	result := make([]pinView, len(pins))
+	for i, p := range pins {
+		result[i] = pinView{
+			MsgView:  views[i],
+			PinnedBy: p.PinnedBy,
+			PinnedAt: p.PinnedAt,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conv_id": convId,
+		"pins":    result,
+	})
+}
+
+// post /api/v1/message/:id/pin
+func msgPin(c *gin.Context) {
+	msgPinToggle(c, true)
+}
+
+// post /api/v1/message/:id/unpin
+func msgUnpin(c *gin.Context) {
+	msgPinToggle(c, false)
+}
+
+func msgPinToggle(c *gin.Context, pinned bool) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	if pinned {
+		err = pinMessage(userId, uint(msgId), 0)
+	} else {
+		err = unpinMessage(userId, uint(msgId), 0)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pinned": pinned,
+	})
+}
+
+func processPin(op string, payload []byte, userId, convId int) error {
+	var request struct {
+		MsgId uint `json:"msg_id"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil || request.MsgId == 0 {
+		return errInvalidFrame
+	}
+
+	if op == "pin" {
+		return pinMessage(userId, request.MsgId, convId)
+	}
+	return unpinMessage(userId, request.MsgId, convId)
+}
+
+// pinMessage 置顶消息，群聊仅群主可操作，私聊双方均可，重复置顶不报错
+func pinMessage(userId int, msgId uint, convId int) error {
+	msg, err := findLiveMsg(msgId, convId)
+	if err != nil {
+		return err
+	}
+
+	err = checkConvAdmin(msg.ConvId, userId)
+	if err != nil {
+		return err
+	}
+
+	pin := Pin{ConvId: msg.ConvId, MsgId: msg.ID, PinnedBy: userId}
+	var created bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// 锁住会话设置行，使并发置顶按顺序计数，没有设置时先插入默认行
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&ConvSetting{ConvId: msg.ConvId}).Error
+		if err != nil {
+			return err
+		}
+		var setting ConvSetting
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&setting, "conv_id = ?", msg.ConvId).Error
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		err = tx.Model(&Pin{}).
+			Where("conv_id = ? AND msg_id <> ?", msg.ConvId, msg.ID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= int64(setting.pinLimit()) {
+			return errPinLimit
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&pin)
+		created = result.RowsAffected > 0
+		return result.Error
+	})
+	if errors.Is(err, errPinLimit) {
+		return err
+	}
+	if err != nil {
+		return errInternal
+	}
+
+	if created {
+		broadcast(msg.ConvId, "pinned", gin.H{
+			"conv_id":   msg.ConvId,
+			"msg_id":    msg.ID,
+			"seq":       msg.Seq,
+			"user_id":   userId,
+			"pinned_at": pin.PinnedAt,
+		})
+	}
+	return nil
+}
+
+func unpinMessage(userId int, msgId uint, convId int) error {
+	msg, err := findLiveMsg(msgId, convId)
+	if err != nil {
+		return err
+	}
+
+	err = checkConvAdmin(msg.ConvId, userId)
+	if err != nil {
+		return err
+	}
+
+	result := db.Where("conv_id = ? AND msg_id = ?", msg.ConvId, msg.ID).Delete(&Pin{})
+	if result.Error != nil {
+		return errInternal
+	}
+
+	if result.RowsAffected > 0 {
+		broadcast(msg.ConvId, "unpinned", gin.H{
+			"conv_id": msg.ConvId,
+			"msg_id":  msg.ID,
+			"seq":     msg.Seq,
+			"user_id": userId,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 最后一个连接断开后等待的时间，期间重连不算离线
+const presenceGrace = 10 * time.Second
+
+// PresenceTracker 只统计本实例上的连接，仅适用于单实例部署。
+// 多实例时连接在其他实例上的用户会被报告为离线，某个实例上的连接全部断开后
+// 也会广播离线事件，即使该用户仍连接着其他实例
+type PresenceTracker struct {
+	online  map[int]bool
+	pending map[int]*time.Timer
+	sync.Mutex
+}
+
+var presenceTracker = PresenceTracker{
+	online:  make(map[int]bool),
+	pending: make(map[int]*time.Timer),
+}
+
+type userPresence struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Online   bool       `json:"online"`
+	LastSeen *Timestamp `json:"last_seen"`
+}
+
+func trackConn(cl *wsClient) {
+	clientManager.Lock()
+	if clientManager.users[cl.userId] == nil {
+		clientManager.users[cl.userId] = make(map[*wsClient]bool)
+	}
+	clientManager.users[cl.userId][cl] = true
+	clientManager.Unlock()
+
+	presenceTracker.connect(cl.userId)
+}
+
+func untrackConn(cl *wsClient) {
+	clientManager.Lock()
+	delete(clientManager.users[cl.userId], cl)
+	remaining := len(clientManager.users[cl.userId])
+	if remaining == 0 {
+		delete(clientManager.users, cl.userId)
+	}
+	clientManager.Unlock()
+
+	if remaining == 0 {
+		presenceTracker.disconnect(cl.userId)
+	}
+}
+
+func (p *PresenceTracker) connect(userId int) {
+	p.Lock()
+	if timer, ok := p.pending[userId]; ok {
+		timer.Stop()
+		delete(p.pending, userId)
+	}
+	wasOnline := p.online[userId]
+	p.online[userId] = true
+	p.Unlock()
+
+	if !wasOnline {
+		publishPresence(userId, true, nil)
+	}
+}
+
+func (p *PresenceTracker) disconnect(userId int) {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.pending[userId]; ok {
+		return
+	}
+	p.pending[userId] = time.AfterFunc(presenceGrace, func() {
+		p.expire(userId)
+	})
+}
+
+func (p *PresenceTracker) expire(userId int) {
+	clientManager.RLock()
+	connected := len(clientManager.users[userId]) > 0
+	clientManager.RUnlock()
+
+	p.Lock()
+	delete(p.pending, userId)
+	if connected || !p.online[userId] {
+		p.Unlock()
+		return
+	}
+	delete(p.online, userId)
+	p.Unlock()
+
+	now := utcNow()
+	err := db.Model(&User{}).
+		Where("id = ?", userId).
+		Update("last_seen", now).Error
+	if err != nil {
+		log.Printf("Presence save error: %v", err)
+	}
+
+	publishPresence(userId, false, &now)
+}
+
+// flush 在关闭服务前记录所有在线用户的最后在线时间
+func (p *PresenceTracker) flush() {
+	p.Lock()
+	userIds := make([]int, 0, len(p.online))
+	for userId := range p.online {
+		userIds = append(userIds, userId)
+	}
+	p.Unlock()
+
+	if len(userIds) == 0 {
+		return
+	}
+
+	err := db.Model(&User{}).
+		Where("id IN ?", userIds).
+		Update("last_seen", utcNow()).Error
+	if err != nil {
+		log.Printf("Presence save error: %v", err)
+	}
+}
+
+func (p *PresenceTracker) isOnline(userId int) bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.online[userId]
+}
+
+func publishPresence(userId int, online bool, lastSeen *Timestamp) {
+	audience, err := presenceAudience(userId)
+	if err != nil {
+		log.Printf("Presence audience error: %v", err)
+		return
+	}
+	if len(audience) == 0 {
+		return
+	}
+
+	if lastSeen != nil {
+		var user User
+		err = db.Select("hide_last_seen").First(&user, "id = ?", userId).Error
+		if err != nil || user.HideLastSeen {
+			lastSeen = nil
+		}
+	}
+
+	event := gin.H{
+		"user_id":   userId,
+		"online":    online,
+		"last_seen": lastSeen,
+	}
+	publish(brokerEvent{Kind: eventUser, UserIds: audience, Op: "presence", Payload: event})
+}
+
+// presenceAudience 返回私聊对象与同群成员
+func presenceAudience(userId int) ([]int, error) {
+	var peerIds []int
+	err := db.Model(&DirectConv{}).
+		Where("user_id = ?", userId).
+		Pluck("peer_id", &peerIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var memberIds []int
+	err = db.Model(&GroupMember{}).
+		Distinct("user_id").
+		Where("group_id IN (?)", db.Model(&GroupMember{}).Select("group_id").Where("user_id = ?", userId)).
+		Where("user_id <> ?", userId).
+		Pluck("user_id", &memberIds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool, len(peerIds)+len(memberIds))
+	audience := make([]int, 0, len(peerIds)+len(memberIds))
+	for _, uid := range append(peerIds, memberIds...) {
+		if !seen[uid] {
+			seen[uid] = true
+			audience = append(audience, uid)
+		}
+	}
+	return audience, nil
+}
+
+func withPresence(users []User) []userPresence {
+	list := make([]userPresence, len(users))
+	for i, user := range users {
+		list[i] = userPresence{
+			ID:     user.ID,
+			Name:   user.Name,
+			Online: presenceTracker.isOnline(user.ID),
+		}
+		if !user.HideLastSeen && !list[i].Online {
+			list[i].LastSeen = user.LastSeen
+		}
+	}
+	return list
+}
+
+// post /api/v1/user/privacy
+func resetPrivacy(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	var request struct {
+		HideLastSeen *bool `json:"hide_last_seen" binding:"required"`
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	err = db.Model(&User{}).
+		Where("id = ?", userId).
+		Update("hide_last_seen", *request.HideLastSeen).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "修改失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "修改隐私设置成功",
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	maxSlowMode = 3600 // 慢速模式最长间隔，单位秒
+	sweepEvery  = time.Minute
+)
+
+// retryError 是可在等待后重试的错误，携带需要等待的时长
+type retryError struct {
+	*wsError
+	RetryAfter time.Duration
+}
+
+func (e *retryError) Unwrap() error {
+	return e.wsError
+}
+
+// retryAfterSeconds 向上取整到毫秒，避免客户端过早重试
+func (e *retryError) retryAfterSeconds() float64 {
+	return math.Ceil(e.RetryAfter.Seconds()*1000) / 1000
+}
+
+func errRateLimited(wait time.Duration) error {
+	return &retryError{&wsError{"rate_limited", "发送过于频繁，请稍后再试"}, wait}
+}
+
+func errSlowMode(wait time.Duration) error {
+	return &retryError{&wsError{"slow_mode", "慢速模式已开启，请稍后再试"}, wait}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter 为每个键维护一个令牌桶，每秒补充 rate 个，最多积攒 burst 个。
+// 令牌桶保存在本实例内存中，多实例部署时每个实例各自限流，实际上限是单实例的实例数倍
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[int]*tokenBucket
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[int]*tokenBucket),
+	}
+}
+
+var (
+	userLimiter = newRateLimiter(userRate, userBurst)
+	convLimiter = newRateLimiter(convRate, convBurst)
+)
+
+// refill 返回 key 当前的令牌桶，调用方需持有锁
+func (l *rateLimiter) refill(key int, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if now.After(b.last) {
+		b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	}
+	return b
+}
+
+// wait 返回取得一个令牌前需要等待的时长，不消耗令牌
+func (l *rateLimiter) wait(key int, now time.Time) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	b := l.refill(key, now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) take(key int, now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(key, now).tokens--
+	l.sweep(now)
+}
+
+// sweep 定期清理已经回满的令牌桶，回满的桶与不存在等价
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepEvery {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type slowModeKey struct {
+	convId int
+	userId int
+}
+
+// SlowModeTracker 记录成员在开启慢速模式的会话中最近一次发言的时间。
+// 与 rateLimiter 一样只在本实例生效，多实例时连到不同实例可以绕过慢速模式
+type SlowModeTracker struct {
+	lastSent  map[slowModeKey]time.Time
+	lastSweep time.Time
+	sync.Mutex
+}
+
+var slowModeTracker = SlowModeTracker{
+	lastSent: make(map[slowModeKey]time.Time),
+}
+
+func (t *SlowModeTracker) wait(convId, userId int, interval time.Duration, now time.Time) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	last, ok := t.lastSent[slowModeKey{convId, userId}]
+	if !ok {
+		return 0
+	}
+	return max(0, interval-now.Sub(last))
+}
+
+func (t *SlowModeTracker) record(convId, userId int, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.lastSent[slowModeKey{convId, userId}] = now
+
+	if now.Sub(t.lastSweep) < sweepEvery {
+		return
+	}
+	t.lastSweep = now
+	for key, last := range t.lastSent {
+		if now.Sub(last) > maxSlowMode*time.Second {
+			delete(t.lastSent, key)
+		}
+	}
+}
+
+// checkSendRate 在写库前检查用户与会话的发送频率以及会话的慢速模式，
+// 全部通过后才消耗额度。群主不受慢速模式限制
+func checkSendRate(convId, userId int) error {
+	now := time.Now()
+
+	wait := max(userLimiter.wait(userId, now), convLimiter.wait(convId, now))
+	if wait > 0 {
+		return errRateLimited(wait)
+	}
+
+	slowMode := false
+	if isGroupConv(convId) {
+		setting, err := convSetting(convId)
+		if err != nil {
+			return errInternal
+		}
+
+		if setting.SlowMode > 0 {
+			isOwner, err := isGroupOwner(convId, userId)
+			if err != nil {
+				return errInternal
+			}
+			slowMode = !isOwner
+		}
+
+		if slowMode {
+			interval := time.Duration(setting.SlowMode) * time.Second
+			wait = slowModeTracker.wait(convId, userId, interval, now)
+			if wait > 0 {
+				return errSlowMode(wait)
+			}
+		}
+	}
+
+	userLimiter.take(userId, now)
+	convLimiter.take(convId, now)
+	if slowMode {
+		slowModeTracker.record(convId, userId, now)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxEmojiLen = 32
+
+var (
+	errInvalidEmoji    = &wsError{"invalid_emoji", "表情无效"}
+	errEmojiNotAllowed = &wsError{"emoji_not_allowed", "该会话不允许使用此表情"}
+)
+
+type reactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	UserIds []int  `json:"user_ids"`
+}
+
+// post /api/v1/message/:id/react
+func msgReact(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var request struct {
+		Emoji string `json:"emoji" binding:"required"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	added, err := toggleReaction(userId, uint(msgId), 0, request.Emoji)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"added": added,
+	})
+}
+
+func processReact(payload []byte, userId, convId int) (any, error) {
+	var request struct {
+		MsgId uint   `json:"msg_id"`
+		Emoji string `json:"emoji"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil || request.MsgId == 0 {
+		return nil, errInvalidFrame
+	}
+
+	added, err := toggleReaction(userId, request.MsgId, convId, request.Emoji)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"added": added,
+	}, nil
+}
+
+// toggleReaction 添加或取消当前用户对消息的表情回应
+func toggleReaction(userId int, msgId uint, convId int, emoji string) (bool, error) {
+	if !validEmoji(emoji) {
+		return false, errInvalidEmoji
+	}
+
+	msg, err := findLiveMsg(msgId, convId)
+	if err != nil {
+		return false, err
+	}
+
+	isMember, err := isConvMember(msg.ConvId, userId)
+	if err != nil {
+		return false, errInternal
+	}
+	if !isMember {
+		return false, errNotMember
+	}
+
+	reaction := Reaction{MsgId: msg.ID, UserId: userId, Emoji: emoji}
+	result := db.Delete(&reaction)
+	if result.Error != nil {
+		return false, errInternal
+	}
+
+	added := result.RowsAffected == 0
+	if added {
+		setting, err := convSetting(msg.ConvId)
+		if err != nil {
+			return false, errInternal
+		}
+		allowed := setting.allowedReactions()
+		if len(allowed) > 0 && !slices.Contains(allowed, emoji) {
+			return false, errEmojiNotAllowed
+		}
+
+		err = db.Create(&reaction).Error
+		if err != nil {
+			return false, errInternal
+		}
+	}
+
+	var count int64
+	db.Model(&Reaction{}).
+		Where("msg_id = ? AND emoji = ?", msg.ID, emoji).
+		Count(&count)
+
+	broadcast(msg.ConvId, "reaction", gin.H{
+		"conv_id": msg.ConvId,
+		"msg_id":  msg.ID,
+		"user_id": userId,
+		"emoji":   emoji,
+		"added":   added,
+		"count":   count,
+	})
+	return added, nil
+}
+
+// validEmoji 只接受 emoji 序列：由 U+200D 连接的若干个元素，每个元素是键帽、
+// 一对区域指示符（国旗），或 Extended_Pictographic 码位加可选的 U+FE0F、肤色和标签序列
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiLen || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	runes := []rune(emoji)
+	for {
+		n := emojiElement(runes)
+		if n == 0 {
+			return false
+		}
+		runes = runes[n:]
+		if len(runes) == 0 {
+			return true
+		}
+		if runes[0] != '\u200D' || len(runes) == 1 {
+			return false
+		}
+		runes = runes[1:]
+	}
+}
+
+// emojiElement 返回 runes 开头的 emoji 元素长度，不是 emoji 时返回 0
+func emojiElement(runes []rune) int {
+	if n := keycapLen(runes); n > 0 {
+		return n
+	}
+
+	if isRegionalIndicator(runes[0]) {
+		if len(runes) > 1 && isRegionalIndicator(runes[1]) {
+			return 2
+		}
+		return 0
+	}
+
+	if !unicode.Is(extendedPictographic, runes[0]) {
+		return 0
+	}
+	n := 1
+	if n < len(runes) && (runes[n] == '\uFE0F' || isSkinTone(runes[n])) {
+		n++
+	}
+	// 🏴 后的标签序列表示地区旗帜，以 U+E007F 结束
+	if n < len(runes) && runes[n] >= 0xE0020 && runes[n] <= 0xE007E {
+		for n < len(runes) && runes[n] >= 0xE0020 && runes[n] <= 0xE007E {
+			n++
+		}
+		if n == len(runes) || runes[n] != 0xE007F {
+			return 0
+		}
+		n++
+	}
+	return n
+}
+
+// keycapLen 返回 runes 开头的键帽序列长度：[0-9#*] 加可选的 U+FE0F，再加 U+20E3
+func keycapLen(runes []rune) int {
+	if len(runes) < 2 || !strings.ContainsRune("0123456789#*", runes[0]) {
+		return 0
+	}
+	n := 1
+	if runes[n] == '\uFE0F' && len(runes) > 2 {
+		n++
+	}
+	if runes[n] != '\u20E3' {
+		return 0
+	}
+	return n + 1
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+// reactionsOf 按消息汇总表情回应，保持首次出现的顺序
+func reactionsOf(msgIds []uint) (map[uint][]reactionCount, error) {
+	grouped := make(map[uint][]reactionCount)
+	if len(msgIds) == 0 {
+		return grouped, nil
+	}
+
+	var reactions []Reaction
+	err := db.Where("msg_id IN ?", msgIds).
+		Order("created_at ASC").
+		Find(&reactions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range reactions {
+		counts := grouped[r.MsgId]
+		i := slices.IndexFunc(counts, func(rc reactionCount) bool {
+			return rc.Emoji == r.Emoji
+		})
+		if i < 0 {
+			counts = append(counts, reactionCount{Emoji: r.Emoji})
+			i = len(counts) - 1
+		}
+		counts[i].Count++
+		counts[i].UserIds = append(counts[i].UserIds, r.UserId)
+		grouped[r.MsgId] = counts
+	}
+	return grouped, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		want  bool
+	}{
+		{"👍", true},
+		{"👍🏽", true},
+		{"❤️", true},
+		{"❤", true},
+		{"©️", true},
+		{"1️⃣", true},
+		{"1⃣", true},
+		{"#️⃣", true},
+		{"*⃣", true},
+		{"🇨🇳", true},
+		{"👨‍👩‍👧", true},
+		{"🏳️‍🌈", true},
+		{"👩🏻‍💻", true},
+		{"🏴\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", true},
+
+		{"", false},
+		{"a", false},
+		{"1", false},
+		{"#", false},
+		{"你好", false},
+		{"傻瓜蛋", false},
+		{"é", false},
+		{"abc", false},
+		{"👍 ", false},
+		{" 👍", false},
+		{"👍a", false},
+		{"#️⃣x", false},
+		{"🇨", false},
+		{"🇨🇳🇺", false},
+		{"🏽", false},
+		{"️", false},
+		{"‍", false},
+		{"👍‍", false},
+		{"‍👍", false},
+		{"👍‍‍👍", false},
+		{"🏴\U000E0067\U000E0062", false},
+		{"\xff", false},
+		{strings.Repeat("👍", 9), false},
+	}
+
+	for _, tt := range tests {
+		got := validEmoji(tt.emoji)
+		if got != tt.want {
+			t.Errorf("validEmoji(%q) = %v, want %v", tt.emoji, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// post /api/v1/conversations/:id/read
+func convRead(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var request struct {
+		MsgId uint `json:"msg_id"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "更新已读失败",
+		})
+		return
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "不是会话成员",
+		})
+		return
+	}
+
+	err = readUpTo(convId, userId, request.MsgId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "更新已读失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "已读",
+	})
+}
+
+// get /api/v1/conversations/unread
+func convUnread(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convIds, err := userConvIds(userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索未读失败",
+		})
+		return
+	}
+
+	unread, err := unreadCounts(userId, convIds)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "检索未读失败",
+		})
+		return
+	}
+
+	var total int64
+	for _, n := range unread {
+		total += n
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":         total,
+		"conversations": unread,
+	})
+}
+
+// get /api/v1/message/:id/receipt
+func msgReceipt(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var msg Msg
+	err = db.Select("id", "conv_id", "user_id").First(&msg, "id = ?", msgId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "消息不存在",
+			})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "查找消息失败",
+			})
+		}
+		return
+	}
+
+	isMember, err := isConvMember(msg.ConvId, userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "查找消息失败",
+		})
+		return
+	}
+	if !isMember {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "不是会话成员",
+		})
+		return
+	}
+
+	isGroup := isGroupConv(msg.ConvId)
+	query := db.Where("conv_id = ? AND user_id <> ? AND last_read_id >= ?", msg.ConvId, msg.UserId, msg.ID)
+	if isGroup {
+		// 已退群成员的已读记录仍然保留，不计入回执
+		query = query.Where("user_id IN (SELECT user_id FROM group_members WHERE group_id = ?)", msg.ConvId)
+	}
+
+	var reads []ConvRead
+	err = query.Find(&reads).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "查找回执失败",
+		})
+		return
+	}
+
+	if !isGroup {
+		// 早于已读记录的历史消息只知道已读，不知道时间
+		var readAt *Timestamp
+		if len(reads) > 0 {
+			var advance ReadAdvance
+			err = db.Where("conv_id = ? AND user_id = ? AND up_to_id >= ?", msg.ConvId, reads[0].UserId, msg.ID).
+				Order("up_to_id").
+				Limit(1).
+				Find(&advance).Error
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error": "查找回执失败",
+				})
+				return
+			}
+			if advance.ID != 0 {
+				readAt = &advance.ReadAt
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"msg_id":  msg.ID,
+			"read":    len(reads) > 0,
+			"read_at": readAt,
+		})
+		return
+	}
+
+	// 发送者可能已经退群，直接按其他成员计数
+	var members int64
+	err = db.Model(&GroupMember{}).
+		Where("group_id = ? AND user_id <> ?", msg.ConvId, msg.UserId).
+		Count(&members).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "查找回执失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg_id":       msg.ID,
+		"read_count":   len(reads),
+		"member_count": members,
+	})
+}
+
+func processRead(message []byte, userId, convId int) error {
+	var event struct {
+		MsgId uint `json:"msg_id"`
+	}
+	err := json.Unmarshal(message, &event)
+	if err != nil {
+		return errInvalidFrame
+	}
+
+	return readUpTo(convId, userId, event.MsgId)
+}
+
+// readUpTo 推进已读游标，msgId 为 0 时读到最新一条，
+// 游标前进后向会话广播回执
+func readUpTo(convId, userId int, msgId uint) error {
+	latest, err := latestMsgId(convId)
+	if err != nil {
+		return err
+	}
+	if msgId == 0 || msgId > latest {
+		msgId = latest
+	}
+
+	advanced, err := markConvRead(convId, userId, msgId)
+	if err != nil || !advanced {
+		return err
+	}
+	markMentionsRead(convId, userId, msgId)
+
+	broadcast(convId, "read", gin.H{
+		"conv_id": convId,
+		"user_id": userId,
+		"msg_id":  msgId,
+		"read_at": utcNow(),
+	})
+	return nil
+}
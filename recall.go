@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errRecallExpired = &wsError{"recall_expired", "已超过可撤回时间"}
+
+// post /api/v1/message/:id/recall
+func msgRecall(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	err = recallMessage(userId, uint(msgId), 0)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "撤回成功",
+	})
+}
+
+// post /api/v1/message/:id/delete
+func msgDelete(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	err = deleteMessage(userId, uint(msgId), 0)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "删除成功",
+	})
+}
+
+func processRemove(op string, payload []byte, userId, convId int) error {
+	var request struct {
+		MsgId uint `json:"msg_id"`
+	}
+	err := json.Unmarshal(payload, &request)
+	if err != nil || request.MsgId == 0 {
+		return errInvalidFrame
+	}
+
+	if op == "recall" {
+		return recallMessage(userId, request.MsgId, convId)
+	}
+	return deleteMessage(userId, request.MsgId, convId)
+}
+
+// recallMessage 撤回作者本人在可撤回时间内的消息
+func recallMessage(userId int, msgId uint, convId int) error {
+	msg, err := findLiveMsg(msgId, convId)
+	if err != nil {
+		return err
+	}
+
+	if msg.UserId != userId {
+		return errForbidden
+	}
+	if time.Since(msg.Time.Time) > recallWindow {
+		return errRecallExpired
+	}
+
+	isMember, err := isConvMember(msg.ConvId, userId)
+	if err != nil {
+		return errInternal
+	}
+	if !isMember {
+		return errNotMember
+	}
+
+	return removeMessage(msg, userId)
+}
+
+// deleteMessage 群主删除群内任意消息，不受时间限制
+func deleteMessage(userId int, msgId uint, convId int) error {
+	msg, err := findLiveMsg(msgId, convId)
+	if err != nil {
+		return err
+	}
+
+	if !isGroupConv(msg.ConvId) {
+		return errForbidden
+	}
+	isOwner, err := isGroupOwner(msg.ConvId, userId)
+	if err != nil {
+		return errInternal
+	}
+	if !isOwner {
+		return errForbidden
+	}
+
+	return removeMessage(msg, userId)
+}
+
+func findLiveMsg(msgId uint, convId int) (Msg, error) {
+	var msg Msg
+	err := db.First(&msg, "id = ?", msgId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Msg{}, errMsgNotFound
+		}
+		return Msg{}, errInternal
+	}
+
+	if msg.Deleted || convId != 0 && msg.ConvId != convId {
+		return Msg{}, errMsgNotFound
+	}
+	return msg, nil
+}
+
+// removeMessage 将消息替换为墓碑，保留序号与回复关系，
+// 同时清除编辑历史、表情回应、提醒、置顶并解除附件。byUserId 为 0 表示超级管理员
+func removeMessage(msg Msg, byUserId int) error {
+	fileUuid := msgFileUuid(msg)
+	now := utcNow()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("msg_id = ?", msg.ID).Delete(&MsgEdit{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("msg_id = ?", msg.ID).Delete(&Reaction{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("msg_id = ?", msg.ID).Delete(&Mention{}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("msg_id = ?", msg.ID).Delete(&Pin{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&msg).Updates(map[string]interface{}{
+			"text":       "",
+			"file_id":    nil,
+			"deleted":    true,
+			"deleted_at": now,
+			"deleted_by": byUserId,
+		}).Error
+	})
+	if err != nil {
+		return errInternal
+	}
+
+	searcher.unindex(msg.ID)
+	if fileUuid != "" {
+		unlinkFile(fileUuid)
+	}
+
+	broadcast(msg.ConvId, "deleted", gin.H{
+		"conv_id":    msg.ConvId,
+		"msg_id":     msg.ID,
+		"seq":        msg.Seq,
+		"deleted_at": now,
+		"deleted_by": byUserId,
+	})
+	return nil
+}
+
+func msgFileUuid(msg Msg) string {
+	if msg.FileId == nil {
+		return ""
+	}
+	return *msg.FileId
+}
+
+// unlinkFile 在没有其他消息引用时删除附件记录与文件
+func unlinkFile(fileUuid string) {
+	var refs int64
+	err := db.Model(&Msg{}).
+		Where("file_id = ? AND deleted = ?", fileUuid, false).
+		Count(&refs).Error
+	if err != nil || refs > 0 {
+		return
+	}
+
+	err = db.Delete(&File{}, "uuid = ?", fileUuid).Error
+	if err != nil {
+		log.Printf("Unlink file error: %v", err)
+		return
+	}
+
+	err = os.Remove(filepath.Join(uploadPath, fileUuid))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unlink file error: %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const snippetRadius = 30
+
+// messageSearcher 为消息提供全文检索，MySQL 使用 ngram 全文索引，
+// 其他数据库退回到内存倒排索引
+type messageSearcher interface {
+	index(msg Msg)
+	unindex(msgId uint)
+	match(query *gorm.DB, terms []string) *gorm.DB
+}
+
+var searcher messageSearcher
+
+func initSearch() {
+	if db.Dialector.Name() == "mysql" {
+		if !db.Migrator().HasIndex(&Msg{}, "idx_msgs_text_ft") {
+			err := db.Exec("ALTER TABLE msgs ADD FULLTEXT INDEX idx_msgs_text_ft (text) WITH PARSER ngram").Error
+			if err != nil {
+				log.Fatal("[err]", err)
+			}
+		}
+		searcher = mysqlSearcher{}
+		return
+	}
+
+	idx := &invertedIndex{
+		postings: make(map[string]map[uint]struct{}),
+		tokens:   make(map[uint][]string),
+	}
+	var batch []Msg
+	err := db.Select("id", "text", "type").
+		Where("deleted = ?", false).
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			for _, m := range batch {
+				idx.index(m)
+			}
+			return nil
+		}).Error
+	if err != nil {
+		log.Fatal("[err]", err)
+	}
+	searcher = idx
+}
+
+type mysqlSearcher struct{}
+
+func (mysqlSearcher) index(Msg) {}
+
+func (mysqlSearcher) unindex(uint) {}
+
+func (mysqlSearcher) match(query *gorm.DB, terms []string) *gorm.DB {
+	// 布尔模式下每个词作为短语必须出现
+	var b strings.Builder
+	for _, term := range terms {
+		b.WriteString(`+"`)
+		b.WriteString(term)
+		b.WriteString(`" `)
+	}
+	return query.Where("MATCH(msgs.text) AGAINST (? IN BOOLEAN MODE)", b.String())
+}
+
+// invertedIndex 启动时从数据库建立，之后只随本实例发送、编辑和撤回的消息更新。
+// 多实例部署时其他实例上新发的消息搜索不到，直到本实例重启
+type invertedIndex struct {
+	postings map[string]map[uint]struct{}
+	tokens   map[uint][]string
+	sync.RWMutex
+}
+
+func (idx *invertedIndex) index(msg Msg) {
+	idx.unindex(msg.ID)
+
+	tokens := tokenize(msg.Text)
+	idx.Lock()
+	defer idx.Unlock()
+
+	for _, token := range tokens {
+		if idx.postings[token] == nil {
+			idx.postings[token] = make(map[uint]struct{})
+		}
+		idx.postings[token][msg.ID] = struct{}{}
+	}
+	idx.tokens[msg.ID] = tokens
+}
+
+func (idx *invertedIndex) unindex(msgId uint) {
+	idx.Lock()
+	defer idx.Unlock()
+
+	for _, token := range idx.tokens[msgId] {
+		delete(idx.postings[token], msgId)
+		if len(idx.postings[token]) == 0 {
+			delete(idx.postings, token)
+		}
+	}
+	delete(idx.tokens, msgId)
+}
+
+func (idx *invertedIndex) match(query *gorm.DB, terms []string) *gorm.DB {
+	idx.RLock()
+	defer idx.RUnlock()
+
+	var ids map[uint]struct{}
+	for _, term := range terms {
+		for _, token := range tokenize(term) {
+			posting := idx.postings[token]
+			if ids == nil {
+				ids = make(map[uint]struct{}, len(posting))
+				for id := range posting {
+					ids[id] = struct{}{}
+				}
+				continue
+			}
+			for id := range ids {
+				if _, ok := posting[id]; !ok {
+					delete(ids, id)
+				}
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return query.Where("1 = 0")
+	}
+
+	candidates := make([]uint, 0, len(ids))
+	for id := range ids {
+		candidates = append(candidates, id)
+	}
+	return query.Where("msgs.id IN ?", candidates)
+}
+
+// tokenize 拉丁字母与数字按词切分，中日韩文字按单字与二元组切分，
+// 与 MySQL ngram 解析器的默认行为保持一致
+func tokenize(text string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	var word []rune
+	var han []rune
+	flush := func() {
+		if len(word) > 0 {
+			add(string(word))
+			word = word[:0]
+		}
+		for i := range han {
+			add(string(han[i]))
+			if i+1 < len(han) {
+				add(string(han[i : i+2]))
+			}
+		}
+		han = han[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				add(string(word))
+				word = word[:0]
+			}
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(han) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+var searchOperators = regexp.MustCompile(`[+\-<>()~*"@]+`)
+
+func searchTerms(q string) []string {
+	return strings.Fields(searchOperators.ReplaceAllString(q, " "))
+}
+
+// get /api/v1/search
+func msgSearch(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+	page, size := pagination(c)
+
+	terms := searchTerms(c.Query("q"))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "缺少搜索关键词",
+		})
+		return
+	}
+
+	convIds, err := userConvIds(userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "搜索失败",
+		})
+		return
+	}
+
+	if stringConvId := c.Query("conv_id"); stringConvId != "" {
+		convId, err := strconv.Atoi(stringConvId)
+		if err != nil || !slices.Contains(convIds, convId) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "不是会话成员",
+			})
+			return
+		}
+		convIds = []int{convId}
+	}
+
+	if len(convIds) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"results": []gin.H{},
+			"total":   0,
+			"page":    page,
+		})
+		return
+	}
+
+	query := db.Model(&Msg{}).
+		Where("msgs.conv_id IN ? AND msgs.deleted = ?", convIds, false)
+
+	if sender := c.Query("sender"); sender != "" {
+		senderId, err := strconv.Atoi(sender)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "sender 必须是整数",
+			})
+			return
+		}
+		query = query.Where("msgs.user_id = ?", senderId)
+	}
+
+	from, to, ok := timeRange(c, userLocation(userId))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "时间格式无效",
+		})
+		return
+	}
+	if !from.IsZero() {
+		query = query.Where("msgs.time >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("msgs.time < ?", to)
+	}
+
+	switch c.Query("has_attachment") {
+	case "1", "true":
+		query = query.Where("msgs.file_id IS NOT NULL")
+	case "0", "false":
+		query = query.Where("msgs.file_id IS NULL")
+	}
+
+	query = searcher.match(query, terms).Session(&gorm.Session{})
+
+	var total int64
+	err = query.Count(&total).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "搜索失败",
+		})
+		return
+	}
+
+	var msgs []Msg
+	err = query.Order("msgs.id DESC").
+		Offset((page - 1) * size).
+		Limit(size).
+		Find(&msgs).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "搜索失败",
+		})
+		return
+	}
+
+	fillSenderNames(msgs)
+	results := make([]gin.H, len(msgs))
+	for i, m := range msgs {
+		results[i] = gin.H{
+			"id":        m.ID,
+			"conv_id":   m.ConvId,
+			"seq":       m.Seq,
+			"user_id":   m.UserId,
+			"user_name": m.UserName,
+			"type":      m.Type,
+			"time":      m.Time,
+			"snippet":   highlight(m.Text, terms),
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"total":   total,
+		"page":    page,
+	})
+}
+
+// timeRange 解析 from 与 to 参数，支持 RFC 3339 与按用户时区理解的日期，
+// 日期形式的 to 包含当天
+func timeRange(c *gin.Context, loc *time.Location) (from, to time.Time, ok bool) {
+	parse := func(value string, endOfDay bool) (time.Time, bool) {
+		if value == "" {
+			return time.Time{}, true
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, true
+		}
+		t, err := time.ParseInLocation(time.DateOnly, value, loc)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, true
+	}
+
+	from, okFrom := parse(c.Query("from"), false)
+	to, okTo := parse(c.Query("to"), true)
+	return from, to, okFrom && okTo
+}
+
+// highlight 截取首个命中附近的片段，转义后用 <mark> 标出关键词
+func highlight(text string, terms []string) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(runes) {
+		lower = runes
+	}
+
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		t := []rune(strings.ToLower(term))
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if slices.Equal(lower[i:i+len(t)], t) {
+				spans = append(spans, span{i, i + len(t)})
+				i += len(t) - 1
+			}
+		}
+	}
+	slices.SortFunc(spans, func(a, b span) int { return a.start - b.start })
+
+	start, end := 0, min(len(runes), 2*snippetRadius)
+	if len(spans) > 0 {
+		start = max(0, spans[0].start-snippetRadius)
+		end = min(len(runes), spans[0].end+snippetRadius)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, s := range spans {
+		if s.start < pos || s.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:s.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[s.start:s.end])))
+		b.WriteString("</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
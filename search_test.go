@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"Hello, World", []string{"hello", "world"}},
+		{"go1.23 go", []string{"go1", "23", "go"}},
+		{"你好", []string{"你", "你好", "好"}},
+		{"你好世界", []string{"你", "你好", "好", "好世", "世", "世界", "界"}},
+		{"用Go写", []string{"用", "go", "写"}},
+		{"开会 开会", []string{"开", "开会", "会"}},
+		{"こんにちは", []string{"こ", "こん", "ん", "んに", "に", "にち", "ち", "ちは", "は"}},
+	}
+
+	for _, tt := range tests {
+		got := tokenize(tt.text)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// matchedIds 在 DryRun 模式下生成查询，返回 match 筛选出的消息 ID
+func matchedIds(t *testing.T, idx *invertedIndex, terms []string) []uint {
+	t.Helper()
+	dry, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmt := idx.match(dry.Model(&Msg{}), terms).Find(&[]Msg{}).Statement
+	if strings.Contains(stmt.SQL.String(), "1 = 0") {
+		return nil
+	}
+	var ids []uint
+	for _, v := range stmt.Vars {
+		id, ok := v.(uint)
+		if !ok {
+			t.Fatalf("unexpected query %s %v", stmt.SQL.String(), stmt.Vars)
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestInvertedIndexMatch(t *testing.T) {
+	idx := &invertedIndex{
+		postings: make(map[string]map[uint]struct{}),
+		tokens:   make(map[uint][]string),
+	}
+	idx.index(Msg{ID: 1, Text: "明天下午开会"})
+	idx.index(Msg{ID: 2, Text: "会议改到明天"})
+	idx.index(Msg{ID: 3, Text: "Release notes for v2"})
+	idx.index(Msg{ID: 4, Text: "release 明天发"})
+
+	tests := []struct {
+		terms []string
+		want  []uint
+	}{
+		{[]string{"明天"}, []uint{1, 2, 4}},
+		{[]string{"开会"}, []uint{1}},
+		{[]string{"明天", "release"}, []uint{4}},
+		{[]string{"RELEASE"}, []uint{3, 4}},
+		{[]string{"后天"}, nil},
+		{[]string{"notes", "明天"}, nil},
+	}
+	for _, tt := range tests {
+		got := matchedIds(t, idx, tt.terms)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("match(%q) = %v, want %v", tt.terms, got, tt.want)
+		}
+	}
+
+	// 编辑后旧词不再命中，撤回后不再出现
+	idx.index(Msg{ID: 1, Text: "明天上午开会"})
+	if got := matchedIds(t, idx, []string{"下午"}); got != nil {
+		t.Errorf("after edit: match(下午) = %v, want none", got)
+	}
+	idx.unindex(2)
+	if got := matchedIds(t, idx, []string{"明天"}); !slices.Equal(got, []uint{1, 4}) {
+		t.Errorf("after unindex: match(明天) = %v, want [1 4]", got)
+	}
+	if _, ok := idx.postings["会议"]; ok {
+		t.Error("empty posting list was not removed")
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("啊", 50)
+	radius := strings.Repeat("啊", snippetRadius)
+
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"明天下午开会", []string{"开会"}, "明天下午<mark>开会</mark>"},
+		{"Go is fun", []string{"go"}, "<mark>Go</mark> is fun"},
+		{"a<b> & c", []string{"b"}, "a&lt;<mark>b</mark>&gt; &amp; c"},
+		{"开会开会", []string{"开会"}, "<mark>开会</mark><mark>开会</mark>"},
+		{"明天开会", []string{"开会", "明天"}, "<mark>明天</mark><mark>开会</mark>"},
+		{"没有命中", []string{"开会"}, "没有命中"},
+		{long + "开会" + long, []string{"开会"}, "…" + radius + "<mark>开会</mark>" + radius + "…"},
+		{long + long, []string{"开会"}, radius + radius + "…"},
+	}
+
+	for _, tt := range tests {
+		got := highlight(tt.text, tt.terms)
+		if got != tt.want {
+			t.Errorf("highlight(%q, %q) = %q, want %q", tt.text, tt.terms, got, tt.want)
+		}
+	}
+}
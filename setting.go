@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxAllowedReactions = 32
+	maxPinLimit         = 100
+)
+
+// get /api/v1/conversations/:id/settings
+func convSettingInfo(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+	if !isMember {
+		abortWithError(c, errNotMember)
+		return
+	}
+
+	setting, err := convSetting(convId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conv_id":           convId,
+		"allowed_reactions": setting.allowedReactions(),
+		"pin_limit":         setting.pinLimit(),
+		"slow_mode":         setting.SlowMode,
+	})
+}
+
+// post /api/v1/conversations/:id/settings
+func convSettingUpdate(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	convId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var request struct {
+		AllowedReactions *[]string `json:"allowed_reactions"`
+		PinLimit         *int      `json:"pin_limit"`
+		SlowMode         *int      `json:"slow_mode"`
+	}
+	err = c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	err = checkConvAdmin(convId, userId)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	setting, err := convSetting(convId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	var updates []string
+	if request.AllowedReactions != nil {
+		allowed := *request.AllowedReactions
+		if len(allowed) > maxAllowedReactions {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "表情数量过多",
+			})
+			return
+		}
+		for _, emoji := range allowed {
+			if !validEmoji(emoji) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": "表情无效",
+				})
+				return
+			}
+		}
+		setting.AllowedReactions = strings.Join(allowed, " ")
+		updates = append(updates, "allowed_reactions")
+	}
+	if request.PinLimit != nil {
+		if *request.PinLimit < 0 || *request.PinLimit > maxPinLimit {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "置顶数量上限无效",
+			})
+			return
+		}
+		setting.PinLimit = *request.PinLimit
+		updates = append(updates, "pin_limit")
+	}
+	if request.SlowMode != nil {
+		if !isGroupConv(convId) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "仅群聊可开启慢速模式",
+			})
+			return
+		}
+		if *request.SlowMode < 0 || *request.SlowMode > maxSlowMode {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "慢速模式间隔无效",
+			})
+			return
+		}
+		setting.SlowMode = *request.SlowMode
+		updates = append(updates, "slow_mode")
+	}
+
+	if len(updates) > 0 {
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "conv_id"}},
+			DoUpdates: clause.AssignmentColumns(updates),
+		}).Create(&setting).Error
+		if err != nil {
+			abortWithError(c, errInternal)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "修改会话设置成功",
+	})
+}
+
+// checkConvAdmin 群聊仅群主可管理，私聊双方均可
+func checkConvAdmin(convId, userId int) error {
+	if isGroupConv(convId) {
+		isOwner, err := isGroupOwner(convId, userId)
+		if err != nil {
+			return errInternal
+		}
+		if !isOwner {
+			return errForbidden
+		}
+		return nil
+	}
+
+	isMember, err := isConvMember(convId, userId)
+	if err != nil {
+		return errInternal
+	}
+	if !isMember {
+		return errNotMember
+	}
+	return nil
+}
+
+func convSetting(convId int) (ConvSetting, error) {
+	var settings []ConvSetting
+	err := db.Where("conv_id = ?", convId).Limit(1).Find(&settings).Error
+	if err != nil || len(settings) == 0 {
+		return ConvSetting{ConvId: convId}, err
+	}
+	return settings[0], nil
+}
+
+func (s ConvSetting) allowedReactions() []string {
+	return strings.Fields(s.AllowedReactions)
+}
+
+// pinLimit 为 0 时使用全局默认值
+func (s ConvSetting) pinLimit() int {
+	if s.PinLimit > 0 {
+		return s.PinLimit
+	}
+	return defaultPinLimit
+}
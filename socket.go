@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 协议版本通过 Sec-WebSocket-Protocol 协商，未声明的客户端使用 v1：
+// v1 为原始 JSON 帧，v2 为 {op, id, payload} 信封并逐帧应答
+const (
+	protoV1     = 1
+	protoV2     = 2
+	protoV2Name = "momo.v2"
+)
+
+const (
+	maxClientIdLen   = 64
+	closeGracePeriod = time.Second
+	frameHardLimit   = 4 // 读取上限为 maxFrameSize 的倍数
+)
+
+var (
+	errConnClosed    = errors.New("connection closed")
+	errSendQueueFull = errors.New("send queue full")
+)
+
+type wsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *wsError) Error() string {
+	return e.Message
+}
+
+var (
+	errInvalidFrame    = &wsError{"bad_request", "请求格式无效"}
+	errUnknownOp       = &wsError{"unknown_op", "未知操作"}
+	errInvalidConv     = &wsError{"invalid_conv", "会话 ID 无效"}
+	errNotMember       = &wsError{"not_member", "不是会话成员"}
+	errEmptyText       = &wsError{"empty_text", "消息内容为空"}
+	errInvalidClientId = &wsError{"invalid_client_id", "client_id 过长"}
+	errMsgNotFound     = &wsError{"not_found", "消息不存在"}
+	errForbidden       = &wsError{"forbidden", "权限不足"}
+	errInternal        = &wsError{"internal", "服务器内部错误"}
+)
+
+// abortWithError 将 wsError 转为 REST 响应
+func abortWithError(c *gin.Context, err error) {
+	var wsErr *wsError
+	if !errors.As(err, &wsErr) {
+		wsErr = errInternal
+	}
+
+	var retryErr *retryError
+	if errors.As(err, &retryErr) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryErr.RetryAfter.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       wsErr.Message,
+			"retry_after": retryErr.retryAfterSeconds(),
+		})
+		return
+	}
+
+	status := http.StatusBadRequest
+	switch wsErr.Code {
+	case errMsgNotFound.Code:
+		status = http.StatusNotFound
+	case errForbidden.Code, errNotMember.Code:
+		status = http.StatusForbidden
+	case errInternal.Code:
+		status = http.StatusInternalServerError
+	}
+
+	c.JSON(status, gin.H{
+		"error": wsErr.Message,
+	})
+}
+
+type wsEnvelope struct {
+	Op      string `json:"op"`
+	Id      string `json:"id,omitempty"`
+	Payload any    `json:"payload,omitempty"`
+}
+
+type wsFrame struct {
+	Op      string          `json:"op"`
+	Id      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func negotiateProto(ws *websocket.Conn) int {
+	if ws.Subprotocol() == protoV2Name {
+		return protoV2
+	}
+	return protoV1
+}
+
+// write 由连接自身的读协程调用，队列已满时等待写协程消费
+func (cl *wsClient) write(v any) error {
+	select {
+	case cl.out <- v:
+		return nil
+	case <-cl.done:
+		return errConnClosed
+	}
+}
+
+// push 供其他协程投递，从不阻塞，队列溢出说明客户端消费过慢，直接断开
+func (cl *wsClient) push(v any) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.pushLocked(v)
+}
+
+// pushLocked 在持有 mu 时投递，补发历史期间暂存，由读协程在补发结束后写出。
+// 暂存的帧同样受 sendQueueSize 限制
+func (cl *wsClient) pushLocked(v any) error {
+	if cl.replaying {
+		if len(cl.pending) < sendQueueSize {
+			cl.pending = append(cl.pending, v)
+			return nil
+		}
+		cl.evict()
+		return errSendQueueFull
+	}
+
+	select {
+	case <-cl.done:
+		return errConnClosed
+	case cl.out <- v:
+		return nil
+	default:
+		cl.evict()
+		return errSendQueueFull
+	}
+}
+
+// writePump 是连接唯一的写协程，同时定期发送 ping，
+// 对端在 pongWait 内没有回应时读协程超时退出
+func (cl *wsClient) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case v := <-cl.out:
+			cl.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := cl.conn.WriteJSON(v)
+			if err != nil {
+				cl.close()
+				return
+			}
+		case <-ticker.C:
+			err := cl.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			if err != nil {
+				cl.close()
+				return
+			}
+		case <-cl.done:
+			return
+		}
+	}
+}
+
+// closeWith 发送关闭帧并断开底层连接，读协程随之退出并完成清理。
+// 可能在广播持锁时调用，因此关闭帧在后台写出
+func (cl *wsClient) closeWith(code int, reason string) {
+	cl.closeOnce.Do(func() {
+		close(cl.done)
+		go func() {
+			cl.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, reason),
+				time.Now().Add(closeGracePeriod))
+			cl.conn.Close()
+		}()
+	})
+}
+
+// evict 断开消费过慢的客户端
+func (cl *wsClient) evict() {
+	log.Printf("Evicting slow client of user %d", cl.userId)
+	cl.closeWith(websocket.ClosePolicyViolation, "send queue overflow")
+}
+
+func (cl *wsClient) close() {
+	cl.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// send 向连接推送一帧，可在任意协程调用
+func (cl *wsClient) send(op string, payload any) error {
+	return cl.push(cl.encode(op, payload))
+}
+
+// deliver 下发会话内的实时帧，该会话正在补发历史时先缓存，缓存同样受 sendQueueSize 限制
+func (cl *wsClient) deliver(convId int, op string, payload any) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if buffered, ok := cl.replays[convId]; ok {
+		if len(buffered) >= sendQueueSize {
+			cl.evict()
+			return errSendQueueFull
+		}
+		cl.replays[convId] = append(buffered, bufferedFrame{op, payload})
+		return nil
+	}
+	return cl.pushLocked(cl.encode(op, payload))
+}
+
+// flushPending 由读协程写出补发期间暂存的帧，全部写出后恢复直接投递
+func (cl *wsClient) flushPending() error {
+	for {
+		cl.mu.Lock()
+		pending := cl.pending
+		cl.pending = nil
+		if len(pending) == 0 {
+			cl.replaying = false
+		}
+		cl.mu.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, v := range pending {
+			err := cl.write(v)
+			if err != nil {
+				cl.mu.Lock()
+				cl.replaying = false
+				cl.mu.Unlock()
+				return fmt.Errorf("write error: %w", err)
+			}
+		}
+	}
+}
+
+// encode 按连接协商的协议编码下行帧，v1 中消息帧保持原样，
+// 其他事件以 event 字段区分
+func (cl *wsClient) encode(op string, payload any) any {
+	if cl.proto == protoV2 {
+		return wsEnvelope{Op: op, Payload: payload}
+	}
+
+	switch op {
+	case "message", "history":
+		return payload
+	}
+
+	frame := gin.H{"event": op}
+	if h, ok := payload.(gin.H); ok {
+		for k, v := range h {
+			frame[k] = v
+		}
+	}
+	return frame
+}
+
+func (cl *wsClient) hello() {
+	if cl.proto != protoV2 {
+		return
+	}
+	cl.write(wsEnvelope{Op: "hello", Payload: gin.H{
+		"version":  protoV2,
+		"versions": []int{protoV1, protoV2},
+	}})
+}
+
+func (cl *wsClient) ack(id, op string, result any) {
+	if cl.proto == protoV2 {
+		cl.write(wsEnvelope{Op: "ack", Id: id, Payload: result})
+		return
+	}
+
+	// v1 没有应答帧，仅保留需要返回结果的操作
+	if op == "open_direct" {
+		cl.write(cl.encode(op, result))
+	}
+}
+
+func (cl *wsClient) fail(id string, err error) {
+	var wsErr *wsError
+	if !errors.As(err, &wsErr) {
+		wsErr = errInternal
+	}
+
+	var retryAfter any
+	var retryErr *retryError
+	if errors.As(err, &retryErr) {
+		retryAfter = retryErr.retryAfterSeconds()
+	}
+
+	if cl.proto == protoV2 {
+		var payload any = wsErr
+		if retryAfter != nil {
+			payload = gin.H{
+				"code":        wsErr.Code,
+				"message":     wsErr.Message,
+				"retry_after": retryAfter,
+			}
+		}
+		cl.write(wsEnvelope{Op: "error", Id: id, Payload: payload})
+		return
+	}
+
+	frame := gin.H{
+		"event": "error",
+		"code":  wsErr.Code,
+		"error": wsErr.Message,
+	}
+	if retryAfter != nil {
+		frame["retry_after"] = retryAfter
+	}
+	cl.write(frame)
+}
+
+// decode 将客户端帧统一为 op 与 payload，v1 帧整体作为 payload
+func (cl *wsClient) decode(message []byte) (op, id string, payload json.RawMessage, err error) {
+	if cl.proto == protoV2 {
+		var frame wsFrame
+		err = json.Unmarshal(message, &frame)
+		if err != nil || frame.Op == "" {
+			return "", frame.Id, nil, errInvalidFrame
+		}
+		return frame.Op, frame.Id, frame.Payload, nil
+	}
+
+	var frame struct {
+		Event string `json:"event"`
+	}
+	err = json.Unmarshal(message, &frame)
+	if err != nil {
+		return "", "", nil, errInvalidFrame
+	}
+	if frame.Event == "" {
+		frame.Event = "send"
+	}
+	return frame.Event, "", message, nil
+}
+
+// read 读取一帧，超过 maxFrameSize 的帧被丢弃并返回 errFrameTooLarge，
+// 连接保持可用；超过 SetReadLimit 上限的帧由 websocket 库以 1009 断开连接
+func (cl *wsClient) read() ([]byte, error) {
+	_, r, err := cl.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := io.ReadAll(io.LimitReader(r, int64(maxFrameSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) > maxFrameSize {
+		_, err = io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errFrameTooLarge
+	}
+	return message, nil
+}
+
+func logReadError(cl *wsClient, err error) {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		log.Printf("WebSocket of user %d timed out", cl.userId)
+		return
+	}
+	if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+		log.Printf("WebSocket error: %v", err)
+	}
+}
+
+func serveClient(cl *wsClient) {
+	for {
+		message, err := cl.read()
+		if errors.Is(err, errFrameTooLarge) {
+			cl.fail("", err)
+			continue
+		}
+		if err != nil {
+			logReadError(cl, err)
+			return
+		}
+
+		op, id, payload, err := cl.decode(message)
+		if err == nil {
+			var result any
+			result, err = handleOp(cl, op, payload)
+			if err == nil {
+				cl.ack(id, op, result)
+				continue
+			}
+		}
+
+		cl.fail(id, err)
+		log.Printf("Message processing error: %v", err)
+	}
+}
+
+func handleOp(cl *wsClient, op string, payload json.RawMessage) (any, error) {
+	var target struct {
+		ConvId   int    `json:"conv_id"`
+		TargetId int    `json:"target_id"`
+		Since    uint   `json:"since"`
+		SinceSeq uint64 `json:"since_seq"`
+	}
+	if len(payload) > 0 {
+		err := json.Unmarshal(payload, &target)
+		if err != nil {
+			return nil, errInvalidFrame
+		}
+	}
+
+	if op == "open_direct" {
+		convId, err := resolveDirectConv(cl.userId, target.TargetId)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{
+			"conv_id":   convId,
+			"target_id": target.TargetId,
+		}, nil
+	}
+
+	convId := cl.convId
+	if cl.mux {
+		convId = target.ConvId
+	}
+	if convId <= 0 {
+		return nil, errInvalidConv
+	}
+
+	switch op {
+	case "subscribe", "unsubscribe":
+		if !cl.mux {
+			return nil, errUnknownOp
+		}
+	}
+
+	if op == "unsubscribe" {
+		leaveConv(cl, convId)
+		return nil, nil
+	}
+
+	if cl.mux && !clientManager.subscribed(cl, convId) {
+		isMember, err := isConvMember(convId, cl.userId)
+		if err != nil {
+			return nil, errInternal
+		}
+		if !isMember {
+			return nil, errNotMember
+		}
+	}
+
+	switch op {
+	case "subscribe":
+		return nil, joinConv(cl, convId, target.Since, target.SinceSeq)
+	case "send":
+		msg, created, err := processMessage(payload, cl.userId, convId)
+		if err != nil {
+			return nil, err
+		}
+		return gin.H{
+			"conv_id":   msg.ConvId,
+			"msg_id":    msg.ID,
+			"seq":       msg.Seq,
+			"client_id": msg.ClientId,
+			"duplicate": !created,
+		}, nil
+	case "edit":
+		return processEdit(payload, cl.userId, convId)
+	case "react":
+		return processReact(payload, cl.userId, convId)
+	case "recall", "delete":
+		return nil, processRemove(op, payload, cl.userId, convId)
+	case "pin", "unpin":
+		return nil, processPin(op, payload, cl.userId, convId)
+	case "forward":
+		return processForward(payload, cl.userId, convId)
+	case "read":
+		err := processRead(payload, cl.userId, convId)
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	case "typing_start":
+		typingTracker.start(convId, cl.userId)
+		return nil, nil
+	case "typing_stop":
+		typingTracker.stop(convId, cl.userId)
+		return nil, nil
+	default:
+		return nil, errUnknownOp
+	}
+}
+
+// ws /api/v1/ws/user
+func userSocketHandler(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "WebSocket 转换失败",
+		})
+		return
+	}
+
+	client := newWsClient(ws, userId)
+	client.mux = true
+	trackConn(client)
+
+	defer func() {
+		for _, convId := range clientManager.subscriptions(client) {
+			leaveConv(client, convId)
+		}
+		untrackConn(client)
+		client.close()
+	}()
+
+	client.hello()
+	serveClient(client)
+}
+
+// joinConv 订阅会话的实时消息并补发 since 之后的历史
+func joinConv(cl *wsClient, convId int, since uint, sinceSeq uint64) error {
+	if clientManager.subscribed(cl, convId) {
+		return nil
+	}
+
+	err := sendHistoricalMessages(cl, convId, since, sinceSeq)
+	if err != nil {
+		log.Printf("Error sending history: %v", err)
+	}
+
+	err = readUpTo(convId, cl.userId, 0)
+	if err != nil {
+		log.Printf("Error marking read: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	errTextTooLong   = &wsError{"text_too_long", "消息内容过长"}
+	errFrameTooLarge = &wsError{"frame_too_large", "消息帧过大"}
+)
+
+// cleanText 规范化并校验消息文本，空文本与超长文本返回错误
+func cleanText(text string) (string, error) {
+	text = normalizeText(text)
+	if text == "" {
+		return "", errEmptyText
+	}
+	if utf8.RuneCountInString(text) > maxTextLen {
+		return "", errTextTooLong
+	}
+	return text, nil
+}
+
+// normalizeText 去除非法 UTF-8 与控制字符（保留换行和制表符），
+// 转为 NFC 并去掉每行末尾与全文末尾的空白
+func normalizeText(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, text)
+	text = norm.NFC.String(text)
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	return strings.TrimRightFunc(strings.Join(lines, "\n"), unicode.IsSpace)
+}
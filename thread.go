@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var errInvalidReply = &wsError{"invalid_reply", "回复的消息不在该会话中"}
+
+// MsgView 是下发给客户端的消息，附带附件元数据、引用预览、回复数与表情回应
+type MsgView struct {
+	Msg
+	File       *fileInfo       `json:"file,omitempty"`
+	Reply      *convPreview    `json:"reply,omitempty"`
+	ReplyCount int64           `json:"reply_count,omitempty"`
+	Reactions  []reactionCount `json:"reactions,omitempty"`
+}
+
+// get /api/v1/message/:id/thread
+func msgThread(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	msgId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "id 必须是整数",
+		})
+		return
+	}
+
+	var root Msg
+	err = db.First(&root, "id = ?", msgId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			abortWithError(c, errMsgNotFound)
+		} else {
+			abortWithError(c, errInternal)
+		}
+		return
+	}
+
+	isMember, err := isConvMember(root.ConvId, userId)
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+	if !isMember {
+		abortWithError(c, errNotMember)
+		return
+	}
+
+	// 从回复进入时展示其所在的整个线程
+	if root.ThreadId != nil {
+		err = db.First(&root, "id = ?", *root.ThreadId).Error
+		if err != nil {
+			abortWithError(c, errInternal)
+			return
+		}
+	}
+
+	var replies []Msg
+	err = db.Where("thread_id = ?", root.ID).
+		Order("seq ASC").
+		Find(&replies).Error
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	views, err := viewsOf(append([]Msg{root}, replies...))
+	if err != nil {
+		abortWithError(c, errInternal)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"root":        views[0],
+		"replies":     views[1:],
+		"reply_count": len(replies),
+	})
+}
+
+// resolveReply 校验被回复的消息属于同一会话，返回回复对象与线程根
+func resolveReply(convId int, replyTo uint) (*uint, *uint, error) {
+	var parent Msg
+	err := db.Select("id", "conv_id", "thread_id").First(&parent, "id = ?", replyTo).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errInvalidReply
+		}
+		return nil, nil, errInternal
+	}
+
+	if parent.ConvId != convId {
+		return nil, nil, errInvalidReply
+	}
+
+	threadId := parent.ID
+	if parent.ThreadId != nil {
+		threadId = *parent.ThreadId
+	}
+	return &parent.ID, &threadId, nil
+}
+
+// viewsOf 为一批消息补齐附件、引用预览、回复数与表情回应
+func viewsOf(msgs []Msg) ([]MsgView, error) {
+	views := make([]MsgView, len(msgs))
+	if len(msgs) == 0 {
+		return views, nil
+	}
+
+	fillSenderNames(msgs)
+
+	ids := make([]uint, len(msgs))
+	var replyIds []uint
+	for i, m := range msgs {
+		views[i].Msg = m
+		ids[i] = m.ID
+		if m.ReplyTo != nil {
+			replyIds = append(replyIds, *m.ReplyTo)
+		}
+	}
+
+	quotes := make(map[uint]*convPreview, len(replyIds))
+	if len(replyIds) > 0 {
+		var quoted []Msg
+		err := db.Find(&quoted, replyIds).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range quoted {
+			quotes[q.ID] = previewOf(q)
+		}
+	}
+
+	var counts []struct {
+		ThreadId uint
+		Replies  int64
+	}
+	err := db.Model(&Msg{}).
+		Select("thread_id, COUNT(*) AS replies").
+		Where("thread_id IN ?", ids).
+		Group("thread_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	replyCounts := make(map[uint]int64, len(counts))
+	for _, n := range counts {
+		replyCounts[n.ThreadId] = n.Replies
+	}
+
+	reactions, err := reactionsOf(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filesOf(msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range views {
+		if views[i].FileId != nil {
+			views[i].File = files[*views[i].FileId]
+		}
+		if views[i].ReplyTo != nil {
+			views[i].Reply = quotes[*views[i].ReplyTo]
+		}
+		views[i].ReplyCount = replyCounts[views[i].ID]
+		views[i].Reactions = reactions[views[i].ID]
+	}
+	return views, nil
+}
+
+// broadcastThread 在线程新增回复后推送根消息的最新回复数
+func broadcastThread(convId int, rootId uint) {
+	var count int64
+	err := db.Model(&Msg{}).
+		Where("thread_id = ?", rootId).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("Thread count error: %v", err)
+		return
+	}
+
+	broadcast(convId, "thread", gin.H{
+		"conv_id":     convId,
+		"msg_id":      rootId,
+		"reply_count": count,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"time"
+	_ "time/tzdata" // 用户时区在精简镜像中也能解析
+)
+
+// timestampLayout 是接口与实时帧中所有时间的格式：UTC、毫秒精度的 RFC 3339
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp 以 UTC 存储并按 timestampLayout 序列化
+type Timestamp struct {
+	time.Time
+}
+
+func utcNow() Timestamp {
+	return Timestamp{time.Now().UTC().Truncate(time.Millisecond)}
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return []byte(`"` + t.UTC().Format(timestampLayout) + `"`), nil
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	return t.Time.UnmarshalJSON(data)
+}
+
+func (t *Timestamp) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v.UTC()
+	default:
+		return fmt.Errorf("cannot scan %T into Timestamp", value)
+	}
+	return nil
+}
+
+func (t Timestamp) Value() (driver.Value, error) {
+	return t.UTC(), nil
+}
+
+// format 按用户时区格式化，用于导出等服务端渲染的内容
+func (t Timestamp) format(loc *time.Location) string {
+	return t.Time.In(loc).Format(time.DateTime)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	typingThrottle = 3 * time.Second // 同一用户重复广播 typing_start 的最小间隔
+	typingTimeout  = 6 * time.Second // 超时未续期则视为停止输入
+)
+
+type typingKey struct {
+	convId int
+	userId int
+}
+
+type typingState struct {
+	lastSent time.Time
+	lastSeen time.Time
+	timer    *time.Timer
+}
+
+type TypingTracker struct {
+	states map[typingKey]*typingState
+	sync.Mutex
+}
+
+var typingTracker = TypingTracker{
+	states: make(map[typingKey]*typingState),
+}
+
+func (t *TypingTracker) start(convId, userId int) {
+	key := typingKey{convId, userId}
+	now := time.Now()
+
+	t.Lock()
+	state, ok := t.states[key]
+	if !ok {
+		state = &typingState{}
+		state.timer = time.AfterFunc(typingTimeout, func() {
+			t.expire(key, state)
+		})
+		t.states[key] = state
+	} else {
+		state.timer.Reset(typingTimeout)
+	}
+	state.lastSeen = now
+
+	throttled := now.Sub(state.lastSent) < typingThrottle
+	if !throttled {
+		state.lastSent = now
+	}
+	t.Unlock()
+
+	if !throttled {
+		broadcastTyping("typing_start", convId, userId)
+	}
+}
+
+func (t *TypingTracker) stop(convId, userId int) {
+	key := typingKey{convId, userId}
+
+	t.Lock()
+	state, ok := t.states[key]
+	if ok {
+		state.timer.Stop()
+		delete(t.states, key)
+	}
+	t.Unlock()
+
+	if ok {
+		broadcastTyping("typing_stop", convId, userId)
+	}
+}
+
+func (t *TypingTracker) expire(key typingKey, state *typingState) {
+	t.Lock()
+	// 计时器触发时可能已被续期或替换
+	if t.states[key] != state || time.Since(state.lastSeen) < typingTimeout {
+		t.Unlock()
+		return
+	}
+	delete(t.states, key)
+	t.Unlock()
+
+	broadcastTyping("typing_stop", key.convId, key.userId)
+}
+
+func broadcastTyping(event string, convId, userId int) {
+	broadcast(convId, event, gin.H{
+		"conv_id": convId,
+		"user_id": userId,
+	})
+}
@@ -136,7 +136,8 @@ func userRegister(c *gin.Context) {
 func userOwnInfo(c *gin.Context) {
 	userId := c.MustGet("userId").(int)
 
-	userName, err := getNameById(&User{}, userId)
+	var user User
+	err := db.Select("name", "hide_last_seen", "time_zone").First(&user, "id = ?", userId).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{
@@ -151,20 +152,18 @@ func userOwnInfo(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"id":   userId,
-		"name": userName,
+		"id":             userId,
+		"name":           user.Name,
+		"hide_last_seen": user.HideLastSeen,
+		"time_zone":      user.TimeZone,
 	})
 }
 
 // get /api/v1/user/lists
 func userList(c *gin.Context) {
-	var users []struct {
-		ID   int    `json:"id"`
-		Name string `json:"name"`
-	}
+	var users []User
 
-	err := db.Model(&User{}).
-		Select("id", "name").
+	err := db.Select("id", "name", "last_seen", "hide_last_seen").
 		Order("id DESC").
 		Find(&users).Error
 	if err != nil {
@@ -175,7 +174,7 @@ func userList(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"users": users,
+		"users": withPresence(users),
 	})
 }
 
@@ -229,6 +228,8 @@ func resetName(c *gin.Context) {
 		return
 	}
 
+	userDirectory.forget(userId)
+
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "修改用户名成功",
 	})
@@ -304,7 +305,7 @@ func createSession(userId int) (string, error) {
 	session := Session{
 		ID:        uuid.New().String(),
 		UserId:    userId,
-		ExpiresAt: time.Now().Add(72 * time.Hour),
+		ExpiresAt: Timestamp{time.Now().Add(72 * time.Hour)},
 	}
 
 	err := db.Create(&session).Error
@@ -322,7 +323,7 @@ func validateSession(sessionId string) (int, bool) {
 		return 0, false
 	}
 
-	if time.Now().After(session.ExpiresAt) {
+	if time.Now().After(session.ExpiresAt.Time) {
 		return 0, false
 	}
 
@@ -335,3 +336,59 @@ func getNameById[M *User | *Group](model M, id int) (name string, err error) {
 		Scan(&name).Error
 	return name, err
 }
+
+// post /api/v1/user/timezone
+func resetTimeZone(c *gin.Context) {
+	userId := c.MustGet("userId").(int)
+
+	var request struct {
+		TimeZone string `json:"time_zone"`
+	}
+	err := c.ShouldBindJSON(&request)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "请求格式无效",
+		})
+		return
+	}
+
+	// 空值与 "UTC" 都表示 UTC，Local 依赖服务器配置，不允许使用
+	_, err = time.LoadLocation(request.TimeZone)
+	if err != nil || request.TimeZone == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "时区无效",
+		})
+		return
+	}
+
+	err = db.Model(&User{}).
+		Where("id = ?", userId).
+		Update("time_zone", request.TimeZone).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "修改失败",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "修改时区成功",
+	})
+}
+
+// userLocation 返回用户偏好的时区，未设置或无效时为 UTC
+func userLocation(userId int) *time.Location {
+	var timeZone string
+	err := db.Model(&User{}).
+		Where("id = ?", userId).
+		Pluck("time_zone", &timeZone).Error
+	if err != nil {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
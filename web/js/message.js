@@ -66,6 +66,7 @@ function setupChatWebSocket(convId) {
     chatSocket.onmessage = function (event) {
         console.log('收到聊天消息:', event.data);
         const message = JSON.parse(event.data);
+        if (message.event || message.error) return;
         displayChatMessage(message);
     };
 
@@ -78,16 +79,31 @@ function setupChatWebSocket(convId) {
     };
 }
 
+// 服务端时间为 UTC，按浏览器所在时区显示
+function formatTime(time) {
+    return new Date(time).toLocaleString();
+}
+
 function displayChatMessage(message) {
     const chatMessages = document.querySelector('.chat-messages');
     const messageElement = document.createElement('div');
     messageElement.className = message.user_id === userId ? 'message me' : 'message';
 
-    if (message.type === 0) {
+    if (message.deleted) {
+        messageElement.innerHTML = `
+            <div class="header">
+                <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p>
+                <span>${formatTime(message.time)}</span>
+            </div>
+            <div class="content">
+                <p>消息已删除</p>
+            </div>
+        `;
+    } else if (message.type === 0) {
         messageElement.innerHTML = `
             <div class="header">
                 <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p>
-                <span>${message.time}</span>
+                <span>${formatTime(message.time)}</span>
             </div>
             <div class="content">
                 <p>${message.text}</p>
@@ -96,14 +112,14 @@ function displayChatMessage(message) {
     } else if (message.type === 1) {
         messageElement.innerHTML = `
             <div class="header">
-                <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${message.time}</span>
+                <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${formatTime(message.time)}</span>
             </div>
             <div><img src="http://127.0.0.1:8080/api/v1/files/${message.text.slice(0, 36)}"></div>
         `;
     } else {
         messageElement.innerHTML = `
             <div class="header">
-                <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${message.time}</span>
+                <p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${formatTime(message.time)}</span>
             </div>
             <div>
                 <a target="_blank" href="http://127.0.0.1:8080/api/v1/files/${message.text.slice(0, 36)}" download>${message.text.slice(37)}</a>
@@ -157,7 +173,7 @@ function genChatMessage(messages = []) {
     messages.forEach(message => {
         const messageElement = document.createElement('div');
         messageElement.className = message.user_id === userId ? 'message me' : 'message';
-        messageElement.innerHTML = `<div class="header"><p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${message.time}</span></div><div class="content"><p>${message.text}</p></div>`;
+        messageElement.innerHTML = `<div class="header"><p class="user">${message.user_id === userId ? 'You' : message.user_name}</p><span>${formatTime(message.time)}</span></div><div class="content"><p>${message.text}</p></div>`;
         form.appendChild(messageElement);
     });
     return form;